@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/calmh/zfs"
+)
+
+// An access policy limits what a client may do: it may only operate on
+// datasets under the given prefixes and only pass whitelisted options to zfs
+// send and zfs recv. A nil policy allows everything, as for a server started
+// over ssh by a user that could run zfs directly anyway.
+type access struct {
+	identity string
+	prefixes []string
+}
+
+// Options a client of a restricted server may pass to zfs recv and zfs
+// send. The incremental source and resume token options of zfs send are
+// checked separately.
+var (
+	restrictedRecvOptions = map[string]bool{"-F": true, "-u": true, "-s": true}
+	restrictedSendOptions = map[string]bool{"-R": true, "-w": true, "-L": true, "-e": true, "-c": true, "-p": true}
+)
+
+// Properties a client of a restricted server may override when receiving,
+// besides user properties. Any property may be excluded.
+var restrictedRecvProperties = map[string]bool{
+	"readonly":    true,
+	"canmount":    true,
+	"atime":       true,
+	"compression": true,
+}
+
+// Properties a restricted server never takes from a received stream, as
+// streams sent with -p or -R carry those of the source: the mountpoint
+// could mount the dataset over anything, and sharing it would expose it.
+// The server's own policy may still set them.
+var restrictedExcludeProperties = []string{"mountpoint", "sharenfs", "sharesmb"}
+
+// resumeTokenSnapshot returns the snapshot sent when resuming with a token.
+var resumeTokenSnapshot = zfs.ResumeTokenSnapshot
+
+// allowDataset returns an error unless ds is one of the permitted prefixes
+// or a descendant of one.
+func (a *access) allowDataset(ds string) error {
+	if a == nil {
+		return nil
+	}
+	for _, p := range a.prefixes {
+		if ds == p || strings.HasPrefix(ds, p+"/") {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s may not access %s", a.identity, ds)
+}
+
+// check returns an error if the command is not permitted by the policy.
+func (a *access) check(c Command) error {
+	if a == nil {
+		return nil
+	}
+
+	switch c.Command {
+	case CmdListSnapshots, CmdResumeToken, CmdListBookmarks, CmdCreateBookmark, CmdPoolFeatures, CmdListDatasets:
+		return a.allowDataset(c.Params[0])
+
+	case CmdReceive:
+		if err := a.checkRecv(c.Params); err != nil {
+			return err
+		}
+		props, err := decodeRecvProps(c.Data)
+		if err != nil {
+			return err
+		}
+		return a.checkProps(props)
+
+	case CmdSend, CmdEstimateSend:
+		return a.checkSend(c.Params)
+
+	case CmdDestroySnapshots:
+		params := c.Params
+		if params[0] == "-r" && len(params) > 1 {
+			params = params[1:]
+		}
+		return a.allowDataset(params[0])
+
+	default:
+		return fmt.Errorf("%s may not use command %d", a.identity, c.Command)
+	}
+}
+
+// checkRecv verifies zfs recv arguments: whitelisted options followed by the
+// destination dataset.
+func (a *access) checkRecv(args []string) error {
+	last := len(args) - 1
+	for _, arg := range args[:last] {
+		if !restrictedRecvOptions[arg] {
+			return fmt.Errorf("%s may not use zfs recv %s", a.identity, arg)
+		}
+	}
+	return a.allowDataset(args[last])
+}
+
+// checkProps verifies that only whitelisted and user properties are
+// overridden.
+func (a *access) checkProps(p recvProps) error {
+	for name := range p.Set {
+		if !restrictedRecvProperties[name] && !strings.Contains(name, ":") {
+			return fmt.Errorf("%s may not set property %s", a.identity, name)
+		}
+	}
+	return nil
+}
+
+// recvPolicy returns the properties policy of the server with the
+// exclusions of restricted mode added.
+func (a *access) recvPolicy(policy recvProps) recvProps {
+	if a == nil {
+		return policy
+	}
+	return recvProps{Exclude: restrictedExcludeProperties}.merge(policy)
+}
+
+// checkSend verifies zfs send arguments: whitelisted options and incremental
+// sources followed by the snapshot to send, or by -t and a resume token.
+func (a *access) checkSend(args []string) error {
+	last := len(args) - 1
+	for i := 0; i < last; i++ {
+		arg := args[i]
+		switch {
+		case arg == "-I" || arg == "-i":
+			i++
+			if i == last {
+				return fmt.Errorf("%s: zfs send %s requires an argument", a.identity, arg)
+			}
+			// The incremental source is "@snap", "#bookmark" or the same
+			// with a dataset name in front.
+			if ds := strings.FieldsFunc(args[i], isSnapSep); len(ds) > 1 {
+				if err := a.allowDataset(ds[0]); err != nil {
+					return err
+				}
+			}
+		case arg == "-t":
+			// The token names the snapshot, which is what we check.
+			if i+1 != last {
+				return fmt.Errorf("%s: zfs send -t requires a token as the last argument", a.identity)
+			}
+			snap, err := resumeTokenSnapshot(args[last])
+			if err != nil {
+				return fmt.Errorf("%s: zfs send -t: %v", a.identity, err)
+			}
+			return a.allowSnapshot(snap)
+		case !restrictedSendOptions[arg]:
+			return fmt.Errorf("%s may not use zfs send %s", a.identity, arg)
+		}
+	}
+	return a.allowSnapshot(args[last])
+}
+
+// allowSnapshot returns an error unless snap is a snapshot or bookmark of a
+// permitted dataset.
+func (a *access) allowSnapshot(snap string) error {
+	ds := strings.FieldsFunc(snap, isSnapSep)
+	if len(ds) != 2 {
+		return fmt.Errorf("%s: zfs send of %q is not a snapshot", a.identity, snap)
+	}
+	return a.allowDataset(ds[0])
+}
+
+func isSnapSep(r rune) bool {
+	return r == '@' || r == '#'
+}
+
+// loadAuthorizations reads a file of client identities and the dataset
+// prefixes they may access, one identity per line:
+//
+//	# identity   prefixes...
+//	web1         tank/backup/web1
+//	db1          tank/backup/db1 tank/backup/shared
+func loadAuthorizations(file string) (map[string][]string, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	authz := make(map[string][]string)
+	sc := bufio.NewScanner(fd)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected an identity followed by dataset prefixes", file, lineNo)
+		}
+		authz[fields[0]] = append(authz[fields[0]], fields[1:]...)
+	}
+	return authz, sc.Err()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+var testAccess = &access{"web1", []string{"tank/backup/web1", "tank/shared"}}
+
+func TestAccessCheck(t *testing.T) {
+	props, err := recvProps{Set: map[string]string{"canmount": "noauto", "com.example:tag": "x"}}.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	badProps, err := recvProps{Set: map[string]string{"mountpoint": "/etc"}}.encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		c  Command
+		ok bool
+	}{
+		{Command{Command: CmdListSnapshots, Params: []string{"tank/backup/web1"}}, true},
+		{Command{Command: CmdListSnapshots, Params: []string{"tank/backup/web1/sub"}}, true},
+		{Command{Command: CmdListSnapshots, Params: []string{"tank/backup/web10"}}, false},
+		{Command{Command: CmdListSnapshots, Params: []string{"tank/backup"}}, false},
+		{Command{Command: CmdListDatasets, Params: []string{"tank/shared"}}, true},
+		{Command{Command: CmdResumeToken, Params: []string{"tank/other"}}, false},
+		{Command{Command: CmdReceive, Params: []string{"-F", "-u", "tank/backup/web1"}}, true},
+		{Command{Command: CmdReceive, Params: []string{"tank/backup/web1"}, Data: props}, true},
+		{Command{Command: CmdReceive, Params: []string{"tank/backup/web1"}, Data: badProps}, false},
+		{Command{Command: CmdReceive, Params: []string{"tank/backup/web1"}, Data: []byte("garbage")}, false},
+		{Command{Command: CmdSend, Params: []string{"-R", "tank/shared@a"}}, true},
+		{Command{Command: CmdEstimateSend, Params: []string{"tank/other@a"}}, false},
+		{Command{Command: CmdDestroySnapshots, Params: []string{"-r", "tank/backup/web1", "a", "b"}}, true},
+		{Command{Command: CmdDestroySnapshots, Params: []string{"tank/other", "a"}}, false},
+		{Command{Command: CmdVersion, Params: []string{"2"}}, false},
+	}
+	for _, c := range cases {
+		err := testAccess.check(c.c)
+		if c.ok && err != nil {
+			t.Errorf("command %d %v: unexpected error %v", c.c.Command, c.c.Params, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("command %d %v: permitted", c.c.Command, c.c.Params)
+		}
+	}
+
+	var unrestricted *access
+	if err := unrestricted.check(Command{Command: CmdSend, Params: []string{"-D", "tank/other@a"}}); err != nil {
+		t.Errorf("unrestricted: unexpected error %v", err)
+	}
+}
+
+func TestAccessCheckRecv(t *testing.T) {
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"tank/backup/web1"}, true},
+		{[]string{"-F", "-u", "-s", "tank/backup/web1/sub"}, true},
+		{[]string{"tank/backup/web2"}, false},
+		{[]string{"-o", "mountpoint=/etc", "tank/backup/web1"}, false},
+		{[]string{"-d", "tank/backup/web1"}, false},
+		{[]string{"tank/backup/web1", "tank/other"}, false},
+	}
+	for _, c := range cases {
+		err := testAccess.checkRecv(c.args)
+		if c.ok && err != nil {
+			t.Errorf("%v: unexpected error %v", c.args, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%v: permitted", c.args)
+		}
+	}
+}
+
+func TestAccessCheckSend(t *testing.T) {
+	defer func(fn func(string) (string, error)) { resumeTokenSnapshot = fn }(resumeTokenSnapshot)
+	resumeTokenSnapshot = func(token string) (string, error) {
+		switch token {
+		case "1-web1":
+			return "tank/backup/web1@b", nil
+		case "1-other":
+			return "tank/other@b", nil
+		}
+		return "", fmt.Errorf("invalid token")
+	}
+
+	cases := []struct {
+		args []string
+		ok   bool
+	}{
+		{[]string{"tank/backup/web1@a"}, true},
+		{[]string{"-R", "-w", "-L", "-e", "-c", "-p", "tank/backup/web1@a"}, true},
+		{[]string{"-I", "@a", "tank/backup/web1@b"}, true},
+		{[]string{"-i", "tank/backup/web1#a", "tank/backup/web1@b"}, true},
+		{[]string{"-i", "tank/other@a", "tank/backup/web1@b"}, false},
+		{[]string{"-i", "tank/backup/web1@b"}, false},
+		{[]string{"tank/backup/web1"}, false},
+		{[]string{"tank/other@a"}, false},
+		{[]string{"-D", "tank/backup/web1@a"}, false},
+		{[]string{"-t", "1-web1"}, true},
+		{[]string{"-e", "-t", "1-web1"}, true},
+		{[]string{"-t", "1-other"}, false},
+		{[]string{"-t", "bad"}, false},
+		{[]string{"-t", "1-web1", "tank/backup/web1@a"}, false},
+	}
+	for _, c := range cases {
+		err := testAccess.checkSend(c.args)
+		if c.ok && err != nil {
+			t.Errorf("%v: unexpected error %v", c.args, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("%v: permitted", c.args)
+		}
+	}
+}
+
+func TestAccessRecvPolicy(t *testing.T) {
+	policy := recvProps{Set: map[string]string{"sharenfs": "off"}}
+
+	var unrestricted *access
+	if p := unrestricted.recvPolicy(policy); !reflect.DeepEqual(p, policy) {
+		t.Errorf("unrestricted policy %+v, expected %+v", p, policy)
+	}
+
+	p := testAccess.recvPolicy(policy)
+	if p.Set["sharenfs"] != "off" {
+		t.Errorf("forced sharenfs lost: %+v", p)
+	}
+	if !reflect.DeepEqual(p.Exclude, []string{"mountpoint", "sharesmb"}) {
+		t.Errorf("excluded %v, expected mountpoint and sharesmb", p.Exclude)
+	}
+
+	// Whatever the client asks for, the stream does not set the mountpoint.
+	client := recvProps{Set: map[string]string{"canmount": "noauto"}, Exclude: []string{"atime"}}
+	args := client.merge(p).args()
+	expected := []string{"-o", "canmount=noauto", "-o", "sharenfs=off", "-x", "mountpoint", "-x", "sharesmb", "-x", "atime"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("recv args %v, expected %v", args, expected)
+	}
+}
@@ -1,51 +1,310 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 )
 
+// The chunked stream format is a sequence of chunks, each consisting of
+//
+//	length  uint32, big endian
+//	crc     uint32, big endian; CRC32C of the payload
+//	payload [length]byte, optionally compressed by the codec
+//
+// terminated by a zero length followed by the SHA-256 of the uncompressed
+// stream. No chunk holds more than the agreed maximum chunk size of
+// uncompressed data. Without checksums, as with version 1 peers, the crc
+// and the SHA-256 are left out.
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+const (
+	// The largest chunk we accept, and so advertise to the peer.
+	defaultMaxChunk = 1 << 20
+	// The smallest maximum chunk size a peer may ask for.
+	minMaxChunk = 1 << 10
+)
+
+// streamParams are the parameters of the chunked streams of a session, as
+// agreed with the peer.
+type streamParams struct {
+	compress  string
+	maxChunk  int
+	checksums bool
+}
+
+func (p streamParams) writer(w io.Writer) (*ChunkedWriter, error) {
+	c, err := newCodec(p.compress)
+	if err != nil {
+		return nil, err
+	}
+	cw := NewChunkedWriter(w, c, p.maxChunk)
+	cw.plain = !p.checksums
+	return cw, nil
+}
+
+func (p streamParams) reader(r io.Reader) (*ChunkedReader, error) {
+	c, err := newCodec(p.compress)
+	if err != nil {
+		return nil, err
+	}
+	cr := NewChunkedReader(r, c, p.maxChunk)
+	cr.plain = !p.checksums
+	return cr, nil
+}
+
+// maxWireChunk returns the largest payload on the wire for a chunk of at
+// most max bytes, allowing for codecs expanding incompressible data.
+func maxWireChunk(max int) int {
+	return max + max/64 + 64
+}
+
+// A ChunkedWriter frames written data as chunks of at most maxChunk bytes.
+// Flush ends the stream.
 type ChunkedWriter struct {
 	io.Writer
+	codec    codec
+	maxChunk int
+	plain    bool // no checksums in the framing
+	buf      bytes.Buffer
+	sha      hash.Hash
+	chunks   int
 }
 
-func (w ChunkedWriter) Write(p []byte) (n int, err error) {
-	l := uint32(len(p))
-	err = binary.Write(w.Writer, binary.BigEndian, &l)
-	if err != nil {
-		return
+func NewChunkedWriter(w io.Writer, c codec, maxChunk int) *ChunkedWriter {
+	return &ChunkedWriter{Writer: w, codec: c, maxChunk: maxChunk, sha: sha256.New()}
+}
+
+func (w *ChunkedWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		l := len(p)
+		if l > w.maxChunk {
+			l = w.maxChunk
+		}
+		err = w.writeChunk(p[:l])
+		if err != nil {
+			return
+		}
+		n += l
+		p = p[l:]
 	}
-	n, err = w.Writer.Write(p)
 	return
 }
 
-func (w ChunkedWriter) Flush() error {
+func (w *ChunkedWriter) writeChunk(p []byte) error {
+	payload := p
+	if w.codec != nil {
+		w.buf.Reset()
+		err := w.codec.encode(&w.buf, p)
+		if err != nil {
+			return err
+		}
+		payload = w.buf.Bytes()
+	}
+
+	hdr := []uint32{uint32(len(payload)), crc32.Checksum(payload, crc32c)}
+	if w.plain {
+		hdr = hdr[:1]
+	}
+	err := binary.Write(w.Writer, binary.BigEndian, hdr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Writer.Write(payload)
+	if err != nil {
+		return err
+	}
+	w.sha.Write(p)
+	w.chunks++
+	return nil
+}
+
+// Flush writes the terminating chunk and checksum trailer.
+func (w *ChunkedWriter) Flush() error {
 	var l uint32
-	return binary.Write(w.Writer, binary.BigEndian, &l)
+	err := binary.Write(w.Writer, binary.BigEndian, &l)
+	if err != nil || w.plain {
+		return err
+	}
+	_, err = w.Writer.Write(w.sha.Sum(nil))
+	return err
+}
+
+// Sum returns the hex SHA-256 of the data written so far.
+func (w *ChunkedWriter) Sum() string {
+	return hex.EncodeToString(w.sha.Sum(nil))
+}
+
+// Chunks returns the number of chunks written so far.
+func (w *ChunkedWriter) Chunks() int {
+	return w.chunks
 }
 
+// A ChunkedReader reads the stream written by a ChunkedWriter with the
+// same codec, verifying the checksums. Reads may be of any size; what does
+// not fit in the caller's buffer is kept for the next read. The last chunk
+// is only returned once the trailer has been verified, so that a consumer
+// such as zfs recv never sees the end of a corrupted stream. After a chunk
+// checksum error reading may continue with the next chunk, as the framing
+// is intact, but the stream as a whole then fails the trailer check. After
+// the end of the stream it keeps returning io.EOF without reading further.
 type ChunkedReader struct {
 	io.Reader
+	codec    codec
+	maxChunk int
+	plain    bool         // no checksums in the framing
+	payload  []byte       // the current chunk as read from the wire
+	buf      bytes.Buffer // the current chunk, decoded
+	pending  []byte       // the unread part of the current chunk
+	sha      hash.Hash
+	chunks   int
+	eof      bool
+	ahead    bool   // the length of the next chunk has been read
+	aheadLen uint32 // and is this
 }
 
-func (r ChunkedReader) Read(bs []byte) (n int, err error) {
-	var l uint32
-	err = binary.Read(r.Reader, binary.BigEndian, &l)
+func NewChunkedReader(r io.Reader, c codec, maxChunk int) *ChunkedReader {
+	return &ChunkedReader{Reader: r, codec: c, maxChunk: maxChunk, sha: sha256.New()}
+}
+
+func (r *ChunkedReader) Read(bs []byte) (int, error) {
+	if len(bs) == 0 {
+		return 0, nil
+	}
+	for len(r.pending) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		err := r.next()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n := copy(bs, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+// next reads the next chunk into pending, or the trailer at the end of the
+// stream in which case io.EOF is returned.
+func (r *ChunkedReader) next() error {
+	var hdr [2]uint32
+	if r.ahead {
+		hdr[0], r.ahead = r.aheadLen, false
+	} else {
+		err := binary.Read(r.Reader, binary.BigEndian, &hdr[0])
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	if hdr[0] == 0 {
+		r.eof = true
+		if r.plain {
+			return io.EOF
+		}
+		return r.verifyTrailer()
+	}
+	if int64(hdr[0]) > int64(maxWireChunk(r.maxChunk)) {
+		return fmt.Errorf("chunk %d: length %d exceeds the maximum chunk size %d", r.chunks, hdr[0], r.maxChunk)
+	}
+
+	if !r.plain {
+		err := binary.Read(r.Reader, binary.BigEndian, &hdr[1])
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+	}
+
+	if cap(r.payload) < int(hdr[0]) {
+		r.payload = make([]byte, hdr[0])
+	}
+	payload := r.payload[:hdr[0]]
+	_, err := io.ReadFull(r.Reader, payload)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	if !r.plain {
+		if crc := crc32.Checksum(payload, crc32c); crc != hdr[1] {
+			return checksumError{fmt.Errorf("chunk %d: checksum mismatch (crc32c %08x != %08x)", r.chunks, crc, hdr[1])}
+		}
+	}
+
+	data := payload
+	if r.codec != nil {
+		r.buf.Reset()
+		err = r.codec.decode(&r.buf, payload, r.maxChunk)
+		if err != nil {
+			return fmt.Errorf("chunk %d: %v", r.chunks, err)
+		}
+		data = r.buf.Bytes()
+	}
+	if len(data) > r.maxChunk {
+		return fmt.Errorf("chunk %d: length %d exceeds the maximum chunk size %d", r.chunks, len(data), r.maxChunk)
+	}
+
+	r.sha.Write(data)
+	r.chunks++
+
+	// Hold the chunk back until we know whether it is the last one, and
+	// if so that the trailer matches.
+	err = binary.Read(r.Reader, binary.BigEndian, &r.aheadLen)
 	if err != nil {
-		return
+		return unexpectedEOF(err)
 	}
+	if r.aheadLen == 0 {
+		r.eof = true
+		if !r.plain {
+			if err := r.verifyTrailer(); err != io.EOF {
+				return err
+			}
+		}
+	} else {
+		r.ahead = true
+	}
+
+	r.pending = data
+	return nil
+}
 
-	if l == 0 {
-		err = io.EOF
-		return
+func (r *ChunkedReader) verifyTrailer() error {
+	var trailer [sha256.Size]byte
+	_, err := io.ReadFull(r.Reader, trailer[:])
+	if err != nil {
+		return unexpectedEOF(err)
 	}
+	if sum := r.sha.Sum(nil); !bytes.Equal(sum, trailer[:]) {
+		return checksumError{fmt.Errorf("stream checksum mismatch (sha256 %x != %x)", sum, trailer)}
+	}
+	return io.EOF
+}
 
-	if int(l) > cap(bs) {
-		err = io.ErrShortBuffer
-		return
+// unexpectedEOF turns io.EOF before the trailer into io.ErrUnexpectedEOF,
+// so that a truncated stream is not taken for a complete one.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
 	}
+	return err
+}
 
-	bs = bs[:l]
-	n, err = io.ReadFull(r.Reader, bs)
-	return
+// A checksumError means the stream was corrupted in transit.
+type checksumError struct {
+	error
+}
+
+// Sum returns the hex SHA-256 of the data read so far.
+func (r *ChunkedReader) Sum() string {
+	return hex.EncodeToString(r.sha.Sum(nil))
+}
+
+// Chunks returns the number of chunks read so far.
+func (r *ChunkedReader) Chunks() int {
+	return r.chunks
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+)
+
+// chunked returns data written as a chunked stream.
+func chunked(t testing.TB, data []byte, compress string, maxChunk int) []byte {
+	var buf bytes.Buffer
+	w, err := streamParams{compress, maxChunk, true}.writer(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// unchunked reads a chunked stream with reads of at most readSize bytes.
+func unchunked(t testing.TB, stream []byte, compress string, maxChunk, readSize int) ([]byte, error) {
+	r, err := streamParams{compress, maxChunk, true}.reader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	buf := make([]byte, readSize)
+	for {
+		n, err := r.Read(buf)
+		out.Write(buf[:n])
+		if err == io.EOF {
+			return out.Bytes(), nil
+		}
+		if err != nil {
+			return out.Bytes(), err
+		}
+	}
+}
+
+func randomData(n int) []byte {
+	bs := make([]byte, n)
+	rand.Read(bs)
+	return bs
+}
+
+func TestChunkedRoundTrip(t *testing.T) {
+	for _, compress := range compressionNames() {
+		f := func(data []byte, maxChunk, readSize uint16) bool {
+			max := minMaxChunk + int(maxChunk)
+			stream := chunked(t, data, compress, max)
+			out, err := unchunked(t, stream, compress, max, 1+int(readSize))
+			return err == nil && bytes.Equal(out, data)
+		}
+		if err := quick.Check(f, nil); err != nil {
+			t.Errorf("%s: %v", compress, err)
+		}
+	}
+}
+
+func TestChunkedReaderSmallReads(t *testing.T) {
+	// A chunk larger than the reader's buffer must be returned over
+	// several reads, not fail with io.ErrShortBuffer.
+	data := randomData(100000)
+	for _, compress := range compressionNames() {
+		stream := chunked(t, data, compress, defaultMaxChunk)
+		r, _ := streamParams{compress, defaultMaxChunk, true}.reader(iotest.OneByteReader(bytes.NewReader(stream)))
+		out, err := ioutil.ReadAll(iotest.OneByteReader(r))
+		if err != nil {
+			t.Fatalf("%s: %v", compress, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: data mismatch", compress)
+		}
+	}
+}
+
+func TestChunkedWriterSplits(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nil, minMaxChunk)
+	n, err := w.Write(randomData(10*minMaxChunk + 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10*minMaxChunk+1 {
+		t.Errorf("wrote %d bytes", n)
+	}
+	if w.Chunks() != 11 {
+		t.Errorf("wrote %d chunks, expected 11", w.Chunks())
+	}
+}
+
+func TestChunkedReaderMaxChunk(t *testing.T) {
+	for _, compress := range compressionNames() {
+		stream := chunked(t, randomData(4*minMaxChunk), compress, 4*minMaxChunk)
+		_, err := unchunked(t, stream, compress, minMaxChunk, 1<<16)
+		if err == nil {
+			t.Errorf("%s: oversized chunk accepted", compress)
+		}
+	}
+
+	// A compressed chunk that expands beyond the maximum.
+	stream := chunked(t, make([]byte, 64*minMaxChunk), "gzip", 64*minMaxChunk)
+	if _, err := unchunked(t, stream, "gzip", minMaxChunk, 1<<16); err == nil {
+		t.Error("oversized decompressed chunk accepted")
+	}
+}
+
+func TestChunkedReaderCorruption(t *testing.T) {
+	data := randomData(3000)
+	for _, compress := range compressionNames() {
+		stream := chunked(t, data, compress, minMaxChunk)
+		for i := range stream {
+			corrupt := append([]byte(nil), stream...)
+			corrupt[i] ^= 0x10
+			if _, err := unchunked(t, corrupt, compress, minMaxChunk, 512); err == nil {
+				t.Fatalf("%s: corruption at byte %d not detected", compress, i)
+			}
+		}
+	}
+}
+
+func TestChunkedReaderTruncated(t *testing.T) {
+	data := randomData(3000)
+	for _, compress := range compressionNames() {
+		stream := chunked(t, data, compress, minMaxChunk)
+		for i := 0; i < len(stream); i++ {
+			_, err := unchunked(t, stream[:i], compress, minMaxChunk, 512)
+			if err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: truncated at %d: got %v, expected io.ErrUnexpectedEOF", compress, i, err)
+			}
+		}
+	}
+}
+
+func TestChunkedReaderStopsAtEnd(t *testing.T) {
+	// Whatever follows the stream belongs to someone else.
+	stream := chunked(t, []byte("hello"), "none", minMaxChunk)
+	in := bytes.NewReader(append(stream, "rest"...))
+	r := NewChunkedReader(in, nil, minMaxChunk)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("read %d, %v after end of stream", n, err)
+	}
+	if in.Len() != len("rest") {
+		t.Errorf("%d bytes left after the stream, expected %d", in.Len(), len("rest"))
+	}
+}
+
+func TestChunkedSums(t *testing.T) {
+	data := randomData(5000)
+	sum := sha256.Sum256(data)
+	var buf bytes.Buffer
+	w := NewChunkedWriter(&buf, nil, minMaxChunk)
+	w.Write(data)
+	w.Flush()
+	r := NewChunkedReader(&buf, nil, minMaxChunk)
+	if _, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+	if w.Sum() != hex.EncodeToString(sum[:]) || r.Sum() != w.Sum() {
+		t.Errorf("sums %s, %s; expected %x", w.Sum(), r.Sum(), sum)
+	}
+	if r.Chunks() != w.Chunks() {
+		t.Errorf("read %d chunks, wrote %d", r.Chunks(), w.Chunks())
+	}
+}
+
+func TestChunkedPlain(t *testing.T) {
+	// Version 1 framing: lengths and payloads only.
+	v1 := []byte{0, 0, 0, 5, 'h', 'e', 'l', 'l', 'o', 0, 0, 0, 1, '!', 0, 0, 0, 0}
+	sp := streamParams{"none", legacyMaxChunk, false}
+
+	r, _ := sp.reader(bytes.NewReader(v1))
+	out, err := ioutil.ReadAll(r)
+	if err != nil || string(out) != "hello!" {
+		t.Errorf("read %q, %v", out, err)
+	}
+
+	var buf bytes.Buffer
+	w, _ := sp.writer(&buf)
+	w.Write([]byte("hello"))
+	w.Write([]byte("!"))
+	w.Flush()
+	if !bytes.Equal(buf.Bytes(), v1) {
+		t.Errorf("wrote %v, expected %v", buf.Bytes(), v1)
+	}
+}
+
+func FuzzChunkedRoundTrip(f *testing.F) {
+	f.Add([]byte("hello world"), uint16(0), uint16(3), false)
+	f.Add(make([]byte, 5000), uint16(100), uint16(1000), true)
+	f.Fuzz(func(t *testing.T, data []byte, maxChunk, readSize uint16, gz bool) {
+		compress := "none"
+		if gz {
+			compress = "gzip"
+		}
+		max := minMaxChunk + int(maxChunk)
+		out, err := unchunked(t, chunked(t, data, compress, max), compress, max, 1+int(readSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatal("data mismatch")
+		}
+	})
+}
+
+func FuzzChunkedReader(f *testing.F) {
+	f.Add(chunked(f, []byte("hello world"), "none", minMaxChunk), false)
+	f.Add(chunked(f, []byte("hello world"), "gzip", minMaxChunk), true)
+	f.Fuzz(func(t *testing.T, stream []byte, gz bool) {
+		compress := "none"
+		if gz {
+			compress = "gzip"
+		}
+		// Arbitrary input must fail cleanly, and anything accepted must
+		// match its checksum.
+		r, _ := streamParams{compress, minMaxChunk, true}.reader(bytes.NewReader(stream))
+		out, err := ioutil.ReadAll(r)
+		if err != nil {
+			return
+		}
+		sum := sha256.Sum256(out)
+		if r.Sum() != hex.EncodeToString(sum[:]) {
+			t.Fatal("accepted stream does not match its checksum")
+		}
+	})
+}
@@ -1,170 +1,730 @@
 package main
 
 import (
-	"bufio"
-	"encoding/gob"
 	"fmt"
-	"io"
-	"os/exec"
+	"math"
 	"strings"
 	"time"
 
 	"github.com/calmh/zfs"
 )
 
-func client(ds, host string) {
-	var command Command
-	var sourceSs string
-	var serverDs string
+func client(source, target string) error {
+	j := newJob(source, target)
+	err := j.parse()
+	if err != nil {
+		return localError(err, "")
+	}
+	return runJobs([]job{j})
+}
+
+// runJobs runs the jobs in order, using one session per remote host. With
+// more than one job, a summary of the results is printed at the end; with
+// --json, a report of the run is always emitted.
+func runJobs(jobs []job) error {
+	t0 := time.Now()
+	sessions := make(map[string]*session)
+	defer func() {
+		for _, s := range sessions {
+			s.abort()
+		}
+	}()
+
+	var firstErr error
+	results := make([]error, len(jobs))
+	reports := make([]*jobReport, len(jobs))
+	for i, j := range jobs {
+		reports[i] = newJobReport(j)
+		jt0 := time.Now()
+
+		var err error
+		s, ok := sessions[j.host]
+		if !ok {
+			s, err = dial(j.host)
+			if err == nil {
+				sessions[j.host] = s
+			}
+		}
+		if err == nil {
+			err = replicate(s, j, reports[i])
+		}
+
+		results[i] = err
+		reports[i].finish(err, jt0)
+		if err != nil {
+			emit("error", j.Name, newErrorEvent(err))
+			if len(jobs) > 1 {
+				logf(INFO, "zsync: job %s: %v\n", j.Name, err)
+			}
+		}
+	}
+
+	for host, s := range sessions {
+		if err := s.Close(); err != nil {
+			logf(INFO, "zsync: closing session to %s: %v\n", host, err)
+		}
+	}
+
+	failed := 0
+	for _, err := range results {
+		if err != nil {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if len(jobs) > 1 {
+		logf(INFO, "zsync: summary: %d jobs, %d succeeded, %d failed\n", len(jobs), len(jobs)-failed, failed)
+		for i, j := range jobs {
+			status := "ok"
+			if results[i] != nil {
+				status = "FAILED: " + results[i].Error()
+			}
+			logf(INFO, "zsync:   %s -> %s: %s\n", j.Source, j.Target, status)
+		}
+		if failed > 0 {
+			firstErr = &exitError{code: exitCode(firstErr), err: fmt.Errorf("%d of %d jobs failed", failed, len(jobs))}
+		}
+	}
+
+	if opts.Metrics != "" && !opts.DryRun {
+		if err := writeMetrics(opts.Metrics, reports, time.Now()); err != nil {
+			logf(INFO, "zsync: writing metrics: %v\n", err)
+			if firstErr == nil {
+				firstErr = localError(fmt.Errorf("writing metrics: %v", err), "")
+			}
+		}
+	}
+
+	report := runReport{Jobs: reports, Succeeded: len(jobs) - failed, Failed: failed, Seconds: time.Since(t0).Seconds()}
+	if firstErr != nil {
+		report.ExitCode = exitCode(firstErr)
+	}
+	emit("report", "", report)
+	return firstErr
+}
 
-	if strings.ContainsRune(host, ':') {
-		fs := strings.SplitN(host, ":", 2)
-		host = fs[0]
-		serverDs = fs[1]
+// replicate brings the destination of the job up to date with its source
+// over the session, recording what it did in r. With --dry-run, it prints
+// what it would do instead.
+func replicate(s *session, j job, r *jobReport) error {
+	if j.Raw {
+		if err := s.require(capRaw); err != nil {
+			return err
+		}
+	}
+	if err := checkSendFlags(s, j); err != nil {
+		return err
+	}
+	if !j.Pull && !j.props.empty() {
+		if err := s.require(capProps); err != nil {
+			return err
+		}
+	}
+
+	if j.Children {
+		return replicateTree(s, j, r)
+	}
+	pending, err := newSnapshot(&j, nil)
+	if err != nil {
+		return err
+	}
+	return replicateDataset(s, j, r, pending)
+}
+
+// newSnapshot takes the snapshot of the job, if any, of the source dataset
+// (recursively with -R) or atomically of the given datasets. With
+// --dry-run, it returns the entry of the snapshot that would have been
+// taken instead.
+func newSnapshot(j *job, datasets []string) (*zfs.SnapshotEntry, error) {
+	if !j.Snapshot {
+		return nil, nil
+	}
+
+	j.snapshot = time.Now().UTC().Format(j.SnapName)
+	if opts.DryRun {
+		// Plan as if the snapshot had been taken, as the newest.
+		return &zfs.SnapshotEntry{Dataset: j.srcDs, Snapshot: j.snapshot, Creation: time.Now(), CreateTxg: math.MaxUint64}, nil
+	}
+	if datasets == nil {
+		datasets = []string{j.srcDs}
+	}
+	err := takeSnapshot(j.snapshot, j.Recursive, datasets...)
+	if err != nil {
+		return nil, err
+	}
+	if len(datasets) > 1 {
+		logf(INFO, "zsync: took snapshot %s@%s and of %d descendants\n", j.srcDs, j.snapshot, len(datasets)-1)
 	} else {
-		serverDs = ds
+		logf(INFO, "zsync: took snapshot %s@%s\n", j.srcDs, j.snapshot)
+	}
+	return nil, nil
+}
+
+// replicateDataset brings the destination dataset of the job up to date
+// with the source dataset. A pending snapshot, not yet taken, is planned for
+// as if it existed.
+func replicateDataset(s *session, j job, r *jobReport, pending *zfs.SnapshotEntry) error {
+	src, dst := j.endpoints(s)
+
+	var resume []string
+	if opts.Resume {
+		token, err := dst.resumeToken(j.dstDs)
+		if err != nil {
+			return err
+		}
+		if token != "" {
+			resume = []string{"-t", token}
+			if !opts.DryRun {
+				logf(INFO, "zsync: resuming interrupted transfer to %s\n", j.dstDs)
+				n, err := transfer(s, j, resume, j.dstDs)
+				r.Bytes += n
+				if err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	if strings.ContainsRune(ds, '@') {
-		fs := strings.SplitN(ds, "@", 2)
-		ds = fs[0]
-		sourceSs = fs[1]
+	p, err := makePlan(s, j, pending)
+	if err != nil {
+		return err
 	}
+	p.Resume = resume
+	r.Snapshot, r.Base, r.NewSnapshot, r.InSync = p.Snapshot, p.Base, p.NewSnapshot, p.InSync
+	r.common = p.common
 
-	sshCmd := exec.Command("ssh", host, opts.ZsyncPath, "--server")
+	if opts.DryRun {
+		return p.show(src)
+	}
+	emit("plan", j.Name, p)
+
+	if p.Snapshot == "" {
+		logf(INFO, "zsync: no snapshot of %s to send\n", j.srcDs)
+		return nil
+	}
 
-	stdin, err := sshCmd.StdinPipe()
-	panicOn(err)
+	if p.InSync {
+		logf(INFO, "zsync: nothing to send (%s in sync)\n", j.dstDs)
+		r.common = p.creation
+	} else {
+		for _, args := range p.Sends {
+			n, err := transfer(s, j, args, args[len(args)-1])
+			r.Bytes += n
+			if err != nil {
+				return err
+			}
+		}
+		r.common = p.creation
+	}
+	if j.Bookmark {
+		bookmarkSnapshot(src, j, p.Snapshot)
+	}
+
+	return prune(src, dst, j)
+}
+
+// bookmarkSnapshot creates a bookmark of the snapshot on the source, named
+// after it, unless there is one already. A failure is only a warning, as
+// the snapshot has been sent; the next run tries again.
+func bookmarkSnapshot(src endpoint, j job, snap string) {
+	bookmarks, err := src.listBookmarks(j.srcDs)
+	if err == nil {
+		for _, b := range bookmarks {
+			if b.Bookmark == snap {
+				return
+			}
+		}
+		err = src.createBookmark(j.srcDs, snap, snap)
+	}
+	if err != nil {
+		logf(INFO, "zsync: warning: bookmarking %s@%s: %v\n", j.srcDs, snap, err)
+		return
+	}
+	logf(VERBOSE, "zsync: created bookmark %s#%s\n", j.srcDs, snap)
+}
 
-	stdout, err := sshCmd.StdoutPipe()
-	panicOn(err)
+// replicateTree replicates the source dataset and each of its descendants
+// separately, each from the latest snapshot it has in common with its
+// destination or in full if it has none, so that a child added later or
+// lacking the common snapshot does not hold up the others. Datasets left
+// out by the child filter are neither snapshotted, sent, nor pruned, so
+// they are not created on the destination and are left alone if they exist
+// there. The results for each dataset are recorded in r.
+func replicateTree(s *session, j job, r *jobReport) error {
+	src, _ := j.endpoints(s)
+	datasets, err := src.listDatasets(j.srcDs)
+	if err != nil {
+		return err
+	}
+	datasets, r.Excluded = j.children.apply(j.srcDs, datasets)
+	for _, name := range r.Excluded {
+		logf(VERBOSE, "zsync: not replicating %s (excluded)\n", name)
+	}
 
-	stderr, err := sshCmd.StderrPipe()
-	panicOn(err)
-	go printLines("remote: ", stderr)
+	var names []string
+	for _, ds := range datasets {
+		names = append(names, ds.Name)
+	}
+	pending, err := newSnapshot(&j, names)
+	if err != nil {
+		return err
+	}
 
-	err = sshCmd.Start()
-	panicOn(err)
+	var firstErr error
+	failed := 0
+	for _, ds := range datasets {
+		cj := j
+		cj.srcDs = ds.Name
+		cj.dstDs = j.dstDs + strings.TrimPrefix(ds.Name, j.srcDs)
+		cr := &jobReport{Job: j.Name, Source: cj.srcDs, Target: cj.dstDs}
+		r.Datasets = append(r.Datasets, cr)
+
+		var cpending *zfs.SnapshotEntry
+		if pending != nil {
+			p := *pending
+			p.Dataset = cj.srcDs
+			cpending = &p
+		}
 
-	e := gob.NewEncoder(stdin)
-	d := gob.NewDecoder(stdout)
+		t0 := time.Now()
+		err := replicateDataset(s, cj, cr, cpending)
+		cr.finish(err, t0)
+		r.Bytes += cr.Bytes
+		if !cr.common.IsZero() && (r.common.IsZero() || cr.common.Before(r.common)) {
+			r.common = cr.common
+		}
+		if err != nil {
+			logf(INFO, "zsync: %s: %v\n", cj.srcDs, err)
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
 
-	negotiateVersion(e, d)
+	r.InSync = true
+	for _, cr := range r.Datasets {
+		r.InSync = r.InSync && cr.InSync
+	}
+	if root := r.Datasets; len(root) > 0 {
+		r.Snapshot, r.Base, r.NewSnapshot = root[0].Snapshot, root[0].Base, root[0].NewSnapshot
+	}
+	logf(VERBOSE, "zsync: %d datasets, %d succeeded, %d failed\n", len(datasets), len(datasets)-failed, failed)
+	for _, cr := range r.Datasets {
+		status := "ok"
+		if !cr.OK {
+			status = "FAILED: " + cr.Error
+		}
+		logf(VERBOSE, "zsync:   %s -> %s: %s\n", cr.Source, cr.Target, status)
+	}
+	if failed > 0 {
+		return &exitError{code: exitCode(firstErr), err: fmt.Errorf("%d of %d datasets failed", failed, len(datasets))}
+	}
+	return nil
+}
 
-	command = Command{Command: CmdListSnapshots, Params: []string{serverDs}}
-	err = e.Encode(&command)
-	panicOn(err)
+// makePlan lists the snapshots on both sides and works out what to send.
+// A pending snapshot, not yet taken, is planned for as if it existed.
+func makePlan(s *session, j job, pending *zfs.SnapshotEntry) (*plan, error) {
+	src, dst := j.endpoints(s)
+	p := newPlan(s, j)
 
-	var serverSnapshots []zfs.SnapshotEntry
-	err = d.Decode(&serverSnapshots)
-	panicOn(err)
+	dstSnapshots, err := listDestination(dst, j.dstDs)
+	if err != nil {
+		return nil, err
+	}
+	emit("snapshots", j.Name, newSnapshotsEvent("destination", dst, j.dstDs, dstSnapshots))
 
-	clientSnapshots, err := zfs.ListSnapshots(ds)
-	panicOn(err)
+	srcSnapshots, err := src.listSnapshots(j.srcDs)
+	if err != nil {
+		return nil, err
+	}
+	emit("snapshots", j.Name, newSnapshotsEvent("source", src, j.srcDs, srcSnapshots))
+	if pending != nil {
+		srcSnapshots = append(srcSnapshots, *pending)
+		p.NewSnapshot = true
+	}
 
 	var toSend *zfs.SnapshotEntry
-	if sourceSs != "" {
-		for i, s := range clientSnapshots {
-			if s.Snapshot == sourceSs {
+	if j.snapshot != "" {
+		for i, s := range srcSnapshots {
+			if s.Snapshot == j.snapshot {
 				toSend = &s
-				clientSnapshots = clientSnapshots[:i+1]
+				srcSnapshots = srcSnapshots[:i+1]
 				break
 			}
 		}
 	} else {
-		toSend = &clientSnapshots[len(clientSnapshots)-1]
-		logf(VERBOSE, "zsync: our latest: %s@%s\n", toSend.Dataset, toSend.Snapshot)
+		for i := len(srcSnapshots) - 1; i >= 0; i-- {
+			if j.selects(srcSnapshots[i].Snapshot) {
+				toSend = &srcSnapshots[i]
+				srcSnapshots = srcSnapshots[:i+1]
+				logf(VERBOSE, "zsync: source latest: %s@%s\n", toSend.Dataset, toSend.Snapshot)
+				break
+			}
+		}
 	}
 
 	if toSend == nil {
-		logf(INFO, "zsync: no snapshot to send\n")
-		return
+		return p, nil
+	}
+	p.Snapshot, p.creation = toSend.Snapshot, toSend.Creation
+
+	// Bookmarks can not be the incremental source of a replication
+	// stream.
+	var bookmarks []zfs.BookmarkEntry
+	if !j.Recursive {
+		bookmarks, err = src.listBookmarks(j.srcDs)
+		if err != nil {
+			return nil, err
+		}
+		bookmarks = bookmarksBefore(bookmarks, *toSend)
 	}
 
-	latest := latestCommon(serverSnapshots, clientSnapshots)
-	if latest != nil {
+	dstLatest, latest, bookmark := latestCommon(dstSnapshots, srcSnapshots, bookmarks)
+	if dstLatest != nil {
+		p.common = dstLatest.Creation
+	}
+	if bookmark != nil {
+		logf(VERBOSE, "zsync: bookmark in common: %s#%s (%s@%s on the destination)\n", bookmark.Dataset, bookmark.Bookmark, dstLatest.Dataset, dstLatest.Snapshot)
+	} else if latest != nil {
 		logf(VERBOSE, "zsync: snapshot in common: %s@%s\n", latest.Dataset, latest.Snapshot)
-		if toSend.Snapshot == latest.Snapshot {
-			logf(INFO, "zsync: nothing to send (destination in sync)\n")
-			return
+		if dstLatest.Snapshot != latest.Snapshot {
+			logf(VERBOSE, "zsync: %s@%s is %s@%s on the destination\n", latest.Dataset, latest.Snapshot, dstLatest.Dataset, dstLatest.Snapshot)
 		}
 	} else {
-		logf(VERBOSE, "zsync: remote dataset missing or no snapshots in common\n")
+		logf(VERBOSE, "zsync: destination dataset missing or no snapshots in common\n")
+		if len(dstSnapshots) > 0 && !j.Rollback {
+			return nil, localError(fmt.Errorf("%s has snapshots but none in common with %s; not sending in full without --rollback", j.dstDs, j.srcDs), "")
+		}
 	}
 
-	params := []string{"send"}
-	if opts.Recursive {
-		params = append(params, "-R")
+	for _, m := range nameMismatches(dstSnapshots, srcSnapshots, latest) {
+		logf(INFO, "zsync: %s@%s and %s@%s have the same name but are different snapshots (guid %d != %d); was the destination rolled back and snapshotted again?\n", m[1].Dataset, m[1].Snapshot, m[0].Dataset, m[0].Snapshot, m[1].GUID, m[0].GUID)
+		if m[1].Snapshot == toSend.Snapshot && !j.Rollback {
+			return nil, localError(fmt.Errorf("%s@%s already exists on the destination as a different snapshot; not sending without --rollback", j.dstDs, toSend.Snapshot), "")
+		}
 	}
-	if latest != nil {
-		params = append(params, "-I", "@"+latest.Snapshot)
+
+	if dstLatest != nil && sameSnapshot(*toSend, *dstLatest) {
+		p.InSync = true
+		return p, nil
 	}
-	params = append(params, ds+"@"+toSend.Snapshot)
 
-	sendCmd := exec.Command("zfs", params...)
-	stream, err := sendCmd.StdoutPipe()
-	panicOn(err)
-	sendStderr, err := sendCmd.StderrPipe()
-	panicOn(err)
+	err = checkEncryption(j, *toSend, dstSnapshots)
+	if err != nil {
+		return nil, err
+	}
 
-	go printLines("zfs send: ", sendStderr)
+	// Send all snapshots since the base at once with -I, or with
+	// snapshot patterns those selected one at a time with -i.
+	flag := "-I"
+	if bookmark != nil {
+		p.Base, flag = "#"+bookmark.Bookmark, "-i"
+	} else if latest != nil {
+		p.Base = "@" + latest.Snapshot
+	}
+	chain := []zfs.SnapshotEntry{*toSend}
+	if j.thinned() {
+		chain, flag = thinChain(j, srcSnapshots, latest, bookmark), "-i"
+	}
 
-	err = sendCmd.Start()
-	panicOn(err)
+	from := p.Base
+	for _, snap := range chain {
+		var args []string
+		if j.Recursive {
+			args = append(args, "-R")
+		}
+		if j.Raw {
+			args = append(args, "-w")
+		}
+		args = append(args, j.SendFlags.args()...)
+		if from != "" {
+			args = append(args, flag, from)
+		}
+		args = append(args, j.srcDs+"@"+snap.Snapshot)
+		p.Sends = append(p.Sends, args)
+		from, flag = "@"+snap.Snapshot, "-i"
+	}
+	p.RecvArgs = append(j.props.args(), recvArgs(j)...)
+	return p, nil
+}
 
-	params = nil
-	if opts.Rollback {
-		params = append(params, "-F")
+// thinChain returns the snapshots after the incremental source, if any,
+// that the job selects, ending with the last of the snapshots, which is the
+// one to send.
+func thinChain(j job, snapshots []zfs.SnapshotEntry, base *zfs.SnapshotEntry, bookmark *zfs.BookmarkEntry) []zfs.SnapshotEntry {
+	start := 0
+	for i, s := range snapshots {
+		if base != nil && sameSnapshot(s, *base) || bookmark != nil && s.CreateTxg <= bookmark.CreateTxg {
+			start = i + 1
+		}
 	}
-	if opts.NoMount {
-		params = append(params, "-u")
+
+	last := len(snapshots) - 1
+	var chain []zfs.SnapshotEntry
+	for _, s := range snapshots[start:last] {
+		if j.selects(s.Snapshot) {
+			chain = append(chain, s)
+		}
 	}
-	params = append(params, serverDs)
-	sc := Command{Command: CmdReceive, Params: params}
-	err = e.Encode(sc)
-	panicOn(err)
+	return append(chain, snapshots[last])
+}
 
-	logf(VERBOSE, "zsync: sending %s@%s\n", toSend.Dataset, toSend.Snapshot)
+// transfer streams "zfs send" with sendArgs from the source to "zfs recv"
+// on the destination of the job, in whichever direction the job goes, and
+// returns the number of bytes sent by zfs.
+func transfer(s *session, j job, sendArgs []string, name string) (int64, error) {
+	emit("stream_start", j.Name, streamStartEvent{Name: name, SendArgs: sendArgs, RecvArgs: append(j.props.args(), recvArgs(j)...)})
 
 	t0 := time.Now()
-	bufout := bufio.NewWriterSize(stdin, opts.bufferBytes)
-	chunkout := ChunkedWriter{bufout}
-	tot, err := io.Copy(chunkout, stream)
-	panicOn(err)
-
-	err = chunkout.Flush()
-	panicOn(err)
+	var st streamStats
+	var err error
+	if j.Pull {
+		st, err = s.pull(sendArgs, recvArgs(j), j.props, name)
+	} else {
+		st, err = s.push(sendArgs, recvArgs(j), j.props, name)
+	}
+	if err != nil {
+		return st.n, err
+	}
 
-	err = bufout.Flush()
-	panicOn(err)
+	emit("stream_end", j.Name, streamEndEvent{Name: name, Bytes: st.n, WireBytes: st.wire, Chunks: st.chunks, SHA256: st.sum, Seconds: time.Since(t0).Seconds()})
+	return st.n, nil
+}
 
-	err = sendCmd.Wait()
-	panicOn(err)
+// checkEncryption verifies that the snapshot can be sent to the
+// destination, given its existing snapshots, with or without --raw. A raw
+// stream of an encrypted dataset can only be received as a new dataset or
+// onto one that was itself received raw, and leaves the destination without
+// the key.
+func checkEncryption(j job, snap zfs.SnapshotEntry, dstSnapshots []zfs.SnapshotEntry) error {
+	encrypted := snap.EncryptionRoot != ""
+	if !j.Raw {
+		if encrypted {
+			logf(INFO, "zsync: warning: %s is encrypted but is sent decrypted; use --raw to keep it encrypted\n", j.srcDs)
+		}
+		return nil
+	}
 
-	err = d.Decode(&command)
-	panicOn(err)
+	if !encrypted {
+		logf(INFO, "zsync: warning: %s is not encrypted; --raw sends it as is\n", j.srcDs)
+		return nil
+	}
+	if len(dstSnapshots) == 0 {
+		return nil
+	}
+	dst := dstSnapshots[len(dstSnapshots)-1]
+	if dst.EncryptionRoot == "" {
+		return localError(fmt.Errorf("%s is not encrypted and can not receive a raw stream of %s", j.dstDs, j.srcDs), "")
+	}
+	if dst.KeyStatus == "available" {
+		logf(INFO, "zsync: warning: the key of %s is loaded on the destination\n", j.dstDs)
+	}
+	return nil
+}
 
-	stdin.Close()
+// checkSendFlags verifies that the server supports the zfs send options of
+// the job and that the destination pool has the features to receive the
+// stream they produce.
+func checkSendFlags(s *session, j job) error {
+	args := j.SendFlags.args()
+	if len(args) == 0 {
+		return nil
+	}
+	if err := s.require(capSendFlags); err != nil {
+		return err
+	}
 
-	err = sshCmd.Wait()
-	panicOn(err)
+	_, dst := j.endpoints(s)
+	features, err := dst.poolFeatures(j.dstDs)
+	if err != nil {
+		return err
+	}
+	err = checkFeatures(zfs.Pool(j.dstDs), features, args)
+	if err != nil {
+		return localError(fmt.Errorf("%s: %v", j.dstDs, err), "")
+	}
+	logf(VERBOSE, "zsync: sending with %v\n", args)
+	return nil
+}
 
-	td := time.Since(t0)
-	logf(INFO, "zsync: sent %s@%s; %sB in %.2f seconds (%sB/s)\n", toSend.Dataset, toSend.Snapshot, toSi(int(tot)), td.Seconds(), toSi(int(float64(tot)/td.Seconds())))
+// listDestination lists the snapshots on the destination dataset, which
+// might not exist yet. Locally that is not an error, as the server also
+// reports it as an empty list.
+func listDestination(dst endpoint, ds string) ([]zfs.SnapshotEntry, error) {
+	snapshots, err := dst.listSnapshots(ds)
+	if zfs.IsNotExist(err) {
+		return nil, nil
+	}
+	return snapshots, err
 }
 
-func latestCommon(o, n []zfs.SnapshotEntry) *zfs.SnapshotEntry {
-	for i := len(n) - 1; i >= 0; i-- {
-		latest := n[i]
-		for j := len(o) - 1; j >= 0; j-- {
-			if o[j].Snapshot == latest.Snapshot {
-				return &o[j]
+// prune applies the retention policy of the job to the source and
+// destination snapshots, always keeping the latest snapshot they have in
+// common so that the next run can be incremental.
+func prune(src, dst endpoint, j job) error {
+	r := j.Retention
+	if !r.enabled() {
+		return nil
+	}
+
+	dstSnapshots, err := dst.listSnapshots(j.dstDs)
+	if err != nil {
+		return err
+	}
+
+	srcSnapshots, err := src.listSnapshots(j.srcDs)
+	if err != nil {
+		return err
+	}
+
+	dstCommon, srcCommon, _ := latestCommon(dstSnapshots, srcSnapshots, nil)
+	if srcCommon == nil {
+		logf(INFO, "zsync: not pruning %s; no snapshot in common with destination\n", j.srcDs)
+		return nil
+	}
+
+	now := time.Now()
+	if r.PruneSource {
+		// A bookmark of the common snapshot can take its place as the
+		// incremental source, except of a replication stream, so then the
+		// snapshot need not be kept.
+		protect := srcCommon.Snapshot
+		if !j.Recursive && srcCommon.GUID != 0 {
+			bookmarks, err := src.listBookmarks(j.srcDs)
+			if err != nil {
+				return err
+			}
+			for _, b := range bookmarks {
+				if b.GUID == srcCommon.GUID {
+					protect = ""
+				}
+			}
+		}
+
+		names := snapshotNames(r.prune(srcSnapshots, now, protect))
+		if len(names) > 0 {
+			err = src.destroySnapshots(j.srcDs, j.Recursive, names)
+			if err != nil {
+				return err
 			}
+			logf(VERBOSE, "zsync: destroyed %d snapshots of %s on %s\n", len(names), j.srcDs, src)
+		}
+	}
+
+	if r.PruneDest {
+		names := snapshotNames(r.prune(dstSnapshots, now, dstCommon.Snapshot))
+		if len(names) > 0 {
+			err = dst.destroySnapshots(j.dstDs, j.Recursive, names)
+			if err != nil {
+				return err
+			}
+			logf(VERBOSE, "zsync: destroyed %d snapshots of %s on %s\n", len(names), j.dstDs, dst)
 		}
 	}
 	return nil
 }
 
+func takeSnapshot(name string, recursive bool, datasets ...string) error {
+	var err error
+	switch {
+	case recursive:
+		err = zfs.TakeSnapshotRecursive(datasets[0], name)
+	case len(datasets) == 1:
+		err = zfs.TakeSnapshot(datasets[0], name)
+	default:
+		err = zfs.TakeSnapshots(name, datasets...)
+	}
+	if err != nil {
+		return localError(fmt.Errorf("taking snapshot %s@%s: %v", datasets[0], name, err), "")
+	}
+	return nil
+}
+
+// recvArgs returns the zfs recv arguments for the job.
+func recvArgs(j job) []string {
+	var params []string
+	if opts.Resume {
+		params = append(params, "-s")
+	}
+	if j.Rollback {
+		params = append(params, "-F")
+	}
+	if j.NoMount {
+		params = append(params, "-u")
+	}
+	return append(params, j.dstDs)
+}
+
+// latestCommon returns the latest source snapshot that is also on the
+// destination, as the destination's and the source's entries for it.
+// Snapshots are matched by GUID, so a renamed snapshot is still found and a
+// different snapshot of the same name is not; only if either side does not
+// report GUIDs are they matched by name. If a source bookmark of a later
+// destination snapshot exists, it is returned along with that snapshot.
+func latestCommon(dst, src []zfs.SnapshotEntry, bookmarks []zfs.BookmarkEntry) (dstSnap, srcSnap *zfs.SnapshotEntry, bookmark *zfs.BookmarkEntry) {
+	for i := len(src) - 1; i >= 0 && srcSnap == nil; i-- {
+		for j := len(dst) - 1; j >= 0; j-- {
+			if sameSnapshot(dst[j], src[i]) {
+				dstSnap, srcSnap = &dst[j], &src[i]
+				break
+			}
+		}
+	}
+
+	for i := len(bookmarks) - 1; i >= 0; i-- {
+		b := &bookmarks[i]
+		if srcSnap != nil && b.CreateTxg <= srcSnap.CreateTxg {
+			break
+		}
+		for j := len(dst) - 1; j >= 0; j-- {
+			if dst[j].GUID != 0 && dst[j].GUID == b.GUID {
+				return &dst[j], srcSnap, b
+			}
+		}
+	}
+	return dstSnap, srcSnap, nil
+}
+
+// bookmarksBefore returns the bookmarks of snapshots older than snap.
+func bookmarksBefore(bookmarks []zfs.BookmarkEntry, snap zfs.SnapshotEntry) []zfs.BookmarkEntry {
+	for i, b := range bookmarks {
+		if b.CreateTxg >= snap.CreateTxg {
+			return bookmarks[:i]
+		}
+	}
+	return bookmarks
+}
+
+func sameSnapshot(a, b zfs.SnapshotEntry) bool {
+	if a.GUID != 0 && b.GUID != 0 {
+		return a.GUID == b.GUID
+	}
+	return a.Snapshot == b.Snapshot
+}
+
+// nameMismatches returns the pairs of destination and source snapshots that
+// have the same name but different GUIDs, among the source snapshots newer
+// than base.
+func nameMismatches(dst, src []zfs.SnapshotEntry, base *zfs.SnapshotEntry) [][2]zfs.SnapshotEntry {
+	var mismatches [][2]zfs.SnapshotEntry
+	for i := len(src) - 1; i >= 0; i-- {
+		if base != nil && sameSnapshot(src[i], *base) {
+			break
+		}
+		for _, d := range dst {
+			if d.Snapshot == src[i].Snapshot && d.GUID != 0 && src[i].GUID != 0 && d.GUID != src[i].GUID {
+				mismatches = append(mismatches, [2]zfs.SnapshotEntry{d, src[i]})
+			}
+		}
+	}
+	return mismatches
+}
+
 func toSi(n int) string {
 	if n > 1e9 {
 		return fmt.Sprintf("%.01fG", float64(n)/1e9)
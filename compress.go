@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A codec compresses and decompresses single chunks of the stream. Decoding
+// fails if a chunk would expand to more than max bytes. Codecs keep state
+// between chunks for efficiency and are not safe for concurrent use.
+type codec interface {
+	encode(dst *bytes.Buffer, p []byte) error
+	decode(dst *bytes.Buffer, p []byte, max int) error
+}
+
+// The available stream compressions. The codec for "none" is nil, meaning
+// chunks are sent as is.
+var codecs = map[string]func() codec{
+	"none": func() codec { return nil },
+	"gzip": newGzipCodec,
+	"lz4":  newLz4Codec,
+}
+
+// The compressions chosen by "auto", fastest first, so that a peer without
+// lz4 gets gzip.
+var autoCompressions = []string{"lz4", "gzip"}
+
+// autoCompression returns the fastest compression both sides support.
+func autoCompression(ours, theirs []string) string {
+	for _, name := range autoCompressions {
+		if contains(ours, name) && contains(theirs, name) {
+			return name
+		}
+	}
+	return "none"
+}
+
+func compressionNames() []string {
+	var names []string
+	for name := range codecs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newCodec(name string) (codec, error) {
+	fn, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression %q", name)
+	}
+	return fn(), nil
+}
+
+type gzipCodec struct {
+	w *gzip.Writer
+	r *gzip.Reader
+}
+
+func newGzipCodec() codec {
+	w, _ := gzip.NewWriterLevel(nil, gzip.BestSpeed)
+	return &gzipCodec{w: w}
+}
+
+func (c *gzipCodec) encode(dst *bytes.Buffer, p []byte) error {
+	c.w.Reset(dst)
+	_, err := c.w.Write(p)
+	if err != nil {
+		return err
+	}
+	return c.w.Close()
+}
+
+func (c *gzipCodec) decode(dst *bytes.Buffer, p []byte, max int) error {
+	var err error
+	if c.r == nil {
+		c.r, err = gzip.NewReader(bytes.NewReader(p))
+	} else {
+		err = c.r.Reset(bytes.NewReader(p))
+	}
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(dst, io.LimitReader(c.r, int64(max)+1))
+	if err != nil {
+		return err
+	}
+	if n > int64(max) {
+		return fmt.Errorf("decompressed chunk exceeds the maximum chunk size %d", max)
+	}
+	return nil
+}
+
+// A countingWriter counts the bytes written through it, i.e. the bytes on
+// the wire when placed underneath a ChunkedWriter.
+type countingWriter struct {
+	io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(bs []byte) (int, error) {
+	n, err := w.Writer.Write(bs)
+	w.n += int64(n)
+	return n, err
+}
+
+// A countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(bs []byte) (int, error) {
+	n, err := r.Reader.Read(bs)
+	r.n += int64(n)
+	return n, err
+}
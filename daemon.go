@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+)
+
+// daemon serves the protocol over TLS on opts.Listen until killed, one
+// session per connection. Clients must present a certificate signed by
+// opts.CACert, and may only access the datasets the authorization file
+// grants the certificate's common name.
+func daemon() error {
+	if opts.Listen == "" || opts.Authorized == "" {
+		return localError(fmt.Errorf("--daemon requires --listen and --authorized"), "")
+	}
+
+	cfg, err := tlsConfig(true)
+	if err != nil {
+		return localError(err, "")
+	}
+
+	authz, err := loadAuthorizations(opts.Authorized)
+	if err != nil {
+		return localError(err, "")
+	}
+
+	if _, err := parseRecvProps(opts.ForceProps, opts.ForceExclude); err != nil {
+		return localError(err, "")
+	}
+
+	ln, err := tls.Listen("tcp", opts.Listen, cfg)
+	if err != nil {
+		return localError(err, "")
+	}
+	defer ln.Close()
+	logf(INFO, "daemon: listening on %s\n", ln.Addr())
+
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			return localError(err, "")
+		}
+		go handle(c.(*tls.Conn), authz)
+	}
+}
+
+func handle(c *tls.Conn, authz map[string][]string) {
+	defer c.Close()
+	addr := c.RemoteAddr()
+
+	err := c.Handshake()
+	if err != nil {
+		logf(INFO, "daemon: %s: %v\n", addr, err)
+		return
+	}
+
+	id := c.ConnectionState().PeerCertificates[0].Subject.CommonName
+	prefixes, ok := authz[id]
+	if !ok {
+		logf(INFO, "daemon: %s: %q is not authorized\n", addr, id)
+		return
+	}
+
+	logf(VERBOSE, "daemon: %s: session for %q\n", addr, id)
+	err = serve(c, c, &access{id, prefixes})
+	if err != nil {
+		logf(INFO, "daemon: %s: %v\n", addr, err)
+		return
+	}
+	logf(VERBOSE, "daemon: %s: session for %q done\n", addr, id)
+}
+
+// tlsConfig loads the certificate, key and CA certificates given in the
+// options. The server requires and verifies client certificates.
+func tlsConfig(server bool) (*tls.Config, error) {
+	if opts.Cert == "" || opts.Key == "" || opts.CACert == "" {
+		return nil, fmt.Errorf("TLS requires --cert, --key and --ca")
+	}
+
+	cert, err := tls.LoadX509KeyPair(opts.Cert, opts.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	bs, err := ioutil.ReadFile(opts.CACert)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bs) {
+		return nil, fmt.Errorf("%s: no certificates found", opts.CACert)
+	}
+
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if server {
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	} else {
+		cfg.RootCAs = pool
+	}
+	return cfg, nil
+}
+
+// tlsTransport connects to a server started with --daemon.
+type tlsTransport struct {
+	port int
+	cfg  *tls.Config
+}
+
+func (t tlsTransport) Dial(host string) (conn, error) {
+	cfg := t.cfg.Clone()
+	cfg.ServerName = host
+	c, err := tls.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(t.port)), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return netConn{c}, nil
+}
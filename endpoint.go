@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/calmh/zfs"
+)
+
+// An endpoint is one side of a replication; either the local host or the
+// server at the other end of a session.
+type endpoint interface {
+	listSnapshots(ds string) ([]zfs.SnapshotEntry, error)
+	resumeToken(ds string) (string, error)
+	destroySnapshots(ds string, recursive bool, names []string) error
+	listBookmarks(ds string) ([]zfs.BookmarkEntry, error)
+	createBookmark(ds, snap, name string) error
+	estimateSend(args []string) (sendEstimate, error)
+	poolFeatures(ds string) (map[string]string, error)
+	listDatasets(ds string) ([]zfs.ListEntry, error)
+	String() string
+}
+
+// localHost is the endpoint on this host, using the zfs package directly.
+type localHost struct{}
+
+func (localHost) String() string {
+	return "local"
+}
+
+func (localHost) listSnapshots(ds string) ([]zfs.SnapshotEntry, error) {
+	snapshots, err := zfs.ListSnapshots(ds)
+	if err != nil {
+		return nil, localError(fmt.Errorf("listing snapshots of %s: %v", ds, err), "")
+	}
+	return snapshots, nil
+}
+
+func (localHost) resumeToken(ds string) (string, error) {
+	token, err := zfs.GetProperty(ds, "receive_resume_token")
+	if err != nil || token == "-" {
+		return "", nil
+	}
+	return token, nil
+}
+
+// listBookmarks lists the bookmarks of ds. If that fails, as when zfs does
+// not support bookmarks, there are none.
+func (localHost) listBookmarks(ds string) ([]zfs.BookmarkEntry, error) {
+	bookmarks, err := zfs.ListBookmarks(ds)
+	if err != nil {
+		logf(DEBUG, "zsync: listing bookmarks of %s: %v\n", ds, err)
+		return nil, nil
+	}
+	return bookmarks, nil
+}
+
+func (localHost) createBookmark(ds, snap, name string) error {
+	err := zfs.CreateBookmark(ds, snap, name)
+	if err != nil {
+		return localError(fmt.Errorf("bookmarking %s@%s: %v", ds, snap, err), "")
+	}
+	return nil
+}
+
+func (localHost) estimateSend(args []string) (sendEstimate, error) {
+	est, err := estimate(args)
+	if err != nil {
+		return est, localError(err, "")
+	}
+	return est, nil
+}
+
+func (localHost) listDatasets(ds string) ([]zfs.ListEntry, error) {
+	datasets, err := zfs.ListDatasets(ds)
+	if err != nil {
+		return nil, localError(fmt.Errorf("listing datasets under %s: %v", ds, err), "")
+	}
+	return datasets, nil
+}
+
+func (localHost) poolFeatures(ds string) (map[string]string, error) {
+	pool := zfs.Pool(ds)
+	features, err := zfs.PoolFeatures(pool)
+	if err != nil {
+		return nil, localError(fmt.Errorf("getting features of pool %s: %v", pool, err), "")
+	}
+	return features, nil
+}
+
+func (localHost) destroySnapshots(ds string, recursive bool, names []string) error {
+	for _, name := range names {
+		var err error
+		if recursive {
+			err = zfs.DestroySnapshotRecursive(ds, name)
+		} else {
+			err = zfs.DestroySnapshot(ds, name)
+		}
+		if err != nil {
+			return localError(fmt.Errorf("destroying %s@%s: %v", ds, name, err), "")
+		}
+		logf(VERBOSE, "zsync: destroyed %s@%s\n", ds, name)
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Exit codes, one per class of failure.
+const (
+	exitUsage    = 2 // bad command line
+	exitLocal    = 3 // a local operation or zfs command failed
+	exitProtocol = 4 // the connection to the peer broke or the peer misbehaved
+	exitRemote   = 5 // the server reported a failure
+)
+
+// An exitError is an error classified by the exit code it should result
+// in, optionally carrying the output of the failing zfs command.
+type exitError struct {
+	code   int
+	err    error
+	stderr string
+}
+
+func (e *exitError) Error() string {
+	if e.code == exitRemote {
+		return "remote: " + e.err.Error()
+	}
+	return e.err.Error()
+}
+
+// Detail returns the tail of the output of the failing command, indented
+// for logging, or the empty string if there is none.
+func (e *exitError) Detail() string {
+	if e.stderr == "" {
+		return ""
+	}
+	return "    " + strings.Replace(e.stderr, "\n", "\n    ", -1) + "\n"
+}
+
+func localError(err error, stderr string) error {
+	return &exitError{exitLocal, err, stderr}
+}
+
+func protocolError(err error) error {
+	return &exitError{exitProtocol, err, ""}
+}
+
+// remoteError constructs the error corresponding to a CmdError reply, which
+// has the error message and command output as parameters.
+func remoteError(c Command) error {
+	e := &exitError{code: exitRemote, err: errors.New("unknown error")}
+	if len(c.Params) > 0 {
+		e.err = errors.New(c.Params[0])
+	}
+	if len(c.Params) > 1 {
+		e.stderr = c.Params[1]
+	}
+	return e
+}
+
+// errorCommand returns the CmdError message reporting err to the peer.
+func errorCommand(err error) Command {
+	c := Command{Command: CmdError, Params: []string{err.Error(), ""}}
+	if e, ok := err.(*exitError); ok {
+		c.Params[1] = e.stderr
+	}
+	return c
+}
+
+func exitCode(err error) int {
+	if e, ok := err.(*exitError); ok {
+		return e.code
+	}
+	return exitLocal
+}
+
+func cmdError(name string, err error, output *lineLog) error {
+	return localError(fmt.Errorf("%s: %v", name, err), output.String())
+}
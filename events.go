@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/calmh/zfs"
+)
+
+// With --json, the client writes what happens during the run to stdout as
+// events, one JSON object per line, ending with a report of the run. The
+// human readable log on stderr is unaffected.
+type event struct {
+	Time  time.Time   `json:"time"`
+	Event string      `json:"event"`
+	Job   string      `json:"job,omitempty"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+// emit writes an event of the given kind, if --json is in effect.
+func emit(kind, job string, data interface{}) {
+	if !opts.JSON {
+		return
+	}
+	e := event{Time: time.Now().UTC(), Event: kind, Job: job, Data: data}
+	if err := json.NewEncoder(os.Stdout).Encode(e); err != nil {
+		logf(INFO, "zsync: writing %s event: %v\n", kind, err)
+	}
+}
+
+type handshakeEvent struct {
+	Host         string   `json:"host"`
+	Protocol     int      `json:"protocol_version"`
+	Capabilities []string `json:"capabilities"`
+	Compression  string   `json:"compression"`
+	MaxChunk     int      `json:"max_chunk"`
+	Checksums    bool     `json:"checksums"`
+}
+
+func newHandshakeEvent(host string, p protocol) handshakeEvent {
+	return handshakeEvent{
+		Host:         host,
+		Protocol:     p.version,
+		Capabilities: p.capabilityNames(),
+		Compression:  p.stream.compress,
+		MaxChunk:     p.stream.maxChunk,
+		Checksums:    p.stream.checksums,
+	}
+}
+
+type snapshotsEvent struct {
+	Side      string         `json:"side"` // "source" or "destination"
+	Host      string         `json:"host"`
+	Dataset   string         `json:"dataset"`
+	Snapshots []snapshotInfo `json:"snapshots"`
+}
+
+type snapshotInfo struct {
+	Name      string    `json:"name"`
+	GUID      uint64    `json:"guid,omitempty"`
+	CreateTxg uint64    `json:"createtxg,omitempty"`
+	Creation  time.Time `json:"creation"`
+}
+
+func newSnapshotsEvent(side string, e endpoint, ds string, snapshots []zfs.SnapshotEntry) snapshotsEvent {
+	ev := snapshotsEvent{Side: side, Host: e.String(), Dataset: ds, Snapshots: []snapshotInfo{}}
+	for _, s := range snapshots {
+		ev.Snapshots = append(ev.Snapshots, snapshotInfo{Name: s.Snapshot, GUID: s.GUID, CreateTxg: s.CreateTxg, Creation: s.Creation})
+	}
+	return ev
+}
+
+type streamStartEvent struct {
+	Name     string   `json:"name"`
+	SendArgs []string `json:"send_args"`
+	RecvArgs []string `json:"recv_args"`
+}
+
+type streamEndEvent struct {
+	Name      string  `json:"name"`
+	Bytes     int64   `json:"bytes"`
+	WireBytes int64   `json:"wire_bytes"`
+	Chunks    int     `json:"chunks,omitempty"`
+	SHA256    string  `json:"sha256,omitempty"`
+	Seconds   float64 `json:"seconds"`
+}
+
+type errorEvent struct {
+	Error    string `json:"error"`
+	Detail   string `json:"detail,omitempty"`
+	ExitCode int    `json:"exit_code"`
+}
+
+func newErrorEvent(err error) errorEvent {
+	ev := errorEvent{Error: err.Error(), ExitCode: exitCode(err)}
+	if e, ok := err.(*exitError); ok {
+		ev.Detail = e.stderr
+	}
+	return ev
+}
+
+// A runReport is the last event of a run.
+type runReport struct {
+	Jobs      []*jobReport `json:"jobs"`
+	Succeeded int          `json:"succeeded"`
+	Failed    int          `json:"failed"`
+	Seconds   float64      `json:"seconds"`
+	ExitCode  int          `json:"exit_code"`
+}
+
+// A jobReport is the outcome of one job.
+type jobReport struct {
+	Job         string  `json:"job"`
+	Source      string  `json:"source"`
+	Target      string  `json:"target"`
+	OK          bool    `json:"ok"`
+	Error       string  `json:"error,omitempty"`
+	ExitCode    int     `json:"exit_code"`
+	Snapshot    string  `json:"snapshot,omitempty"`
+	Base        string  `json:"base,omitempty"`
+	NewSnapshot bool    `json:"new_snapshot,omitempty"`
+	InSync      bool    `json:"in_sync"`
+	Bytes       int64   `json:"bytes"`
+	Seconds     float64 `json:"seconds"`
+
+	// With --children, the results for the source dataset and each of its
+	// descendants.
+	Datasets []*jobReport `json:"datasets,omitempty"`
+	// With --children, the descendants left out by the child filter.
+	Excluded []string `json:"excluded,omitempty"`
+
+	// Creation time of the latest snapshot in common after the run; with
+	// --children, the oldest of those of the datasets.
+	common time.Time
+}
+
+func newJobReport(j job) *jobReport {
+	return &jobReport{Job: j.Name, Source: j.Source, Target: j.Target}
+}
+
+// finish records the result of the job, which started at t0.
+func (r *jobReport) finish(err error, t0 time.Time) {
+	r.Seconds = time.Since(t0).Seconds()
+	r.OK = err == nil
+	if err != nil {
+		r.Error = err.Error()
+		r.ExitCode = exitCode(err)
+	}
+}
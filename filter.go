@@ -0,0 +1,105 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/calmh/zfs"
+)
+
+// A pattern matches names by glob or, when prefixed by "re:", by regular
+// expression.
+type pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func parsePattern(s string) (pattern, error) {
+	if strings.HasPrefix(s, "re:") {
+		re, err := regexp.Compile(s[3:])
+		return pattern{re: re}, err
+	}
+	_, err := path.Match(s, "")
+	return pattern{glob: s}, err
+}
+
+func parsePatterns(ss []string) ([]pattern, error) {
+	var ps []pattern
+	for _, s := range ss {
+		p, err := parsePattern(s)
+		if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func (p pattern) match(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// A childFilter selects the descendants of the source dataset to replicate
+// with --children, by their names relative to it (e.g. "home/cache").
+// Excluding a dataset excludes its descendants, and including one includes
+// its descendants and, so that there is somewhere to receive it, its
+// ancestors. Without include patterns all datasets are included.
+type childFilter struct {
+	include, exclude []pattern
+}
+
+// anyLineage returns whether the relative name or that of an ancestor
+// matches one of the patterns.
+func anyLineage(ps []pattern, rel string) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		name := strings.Join(parts[:i+1], "/")
+		for _, p := range ps {
+			if p.match(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply returns the datasets under root that the filter selects, in the
+// order given, and the names of those it does not. The root itself is
+// always selected.
+func (f childFilter) apply(root string, datasets []zfs.ListEntry) (selected []zfs.ListEntry, excluded []string) {
+	rel := func(name string) string {
+		return strings.TrimPrefix(strings.TrimPrefix(name, root), "/")
+	}
+
+	keep := map[string]bool{"": true}
+	for _, ds := range datasets {
+		r := rel(ds.Name)
+		if r == "" || anyLineage(f.exclude, r) {
+			continue
+		}
+		if len(f.include) > 0 && !anyLineage(f.include, r) {
+			continue
+		}
+		for r != "" {
+			keep[r] = true
+			r = path.Dir(r)
+			if r == "." {
+				r = ""
+			}
+		}
+	}
+
+	for _, ds := range datasets {
+		if keep[rel(ds.Name)] {
+			selected = append(selected, ds)
+		} else {
+			excluded = append(excluded, ds.Name)
+		}
+	}
+	return selected, excluded
+}
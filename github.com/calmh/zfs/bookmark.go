@@ -0,0 +1,68 @@
+package zfs
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type BookmarkEntry struct {
+	Dataset  string
+	Bookmark string
+	Creation time.Time
+	// GUID of the snapshot the bookmark was created from.
+	GUID uint64
+	// Transaction group of the snapshot the bookmark was created from.
+	CreateTxg uint64
+}
+
+// ListBookmarks lists the bookmarks of the specified dataset, oldest first.
+func ListBookmarks(ds string) ([]BookmarkEntry, error) {
+	lines, err := zfs("list", "-Hpo", "name,creation,guid,createtxg", "-s", "createtxg", "-t", "bookmark", "-r", "-d", "1", ds)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]BookmarkEntry, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Unparseable line: %#v", line)
+		}
+
+		nameFields := strings.SplitN(fields[0], "#", 2)
+		if len(nameFields) != 2 {
+			return nil, fmt.Errorf("Unparseable line: %#v", line)
+		}
+		creation, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		guid, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		txg, err := strconv.ParseUint(fields[3], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		e := BookmarkEntry{
+			Dataset:   nameFields[0],
+			Bookmark:  nameFields[1],
+			Creation:  time.Unix(creation, 0),
+			GUID:      guid,
+			CreateTxg: txg,
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// CreateBookmark creates the bookmark called name of the snapshot of
+// dataset.
+func CreateBookmark(dataset, snapshot, name string) error {
+	_, err := zfs("bookmark", dataset+"@"+snapshot, dataset+"#"+name)
+	return err
+}
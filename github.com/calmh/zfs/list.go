@@ -2,6 +2,7 @@ package zfs
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -27,13 +28,30 @@ type SnapshotEntry struct {
 	Used     uint64
 	Refer    uint64
 	Creation time.Time
+	// Globally unique identifier of the snapshot, the same on every host
+	// it has been sent to and unchanged by renames.
+	GUID uint64
+	// Transaction group the snapshot was created in, ordering the
+	// snapshots of a dataset.
+	CreateTxg uint64
+	// Encryption root of the dataset, or "" if it is not encrypted.
+	EncryptionRoot string
+	// "available" or "unavailable" for the key of an encrypted dataset,
+	// otherwise "".
+	KeyStatus string
 }
 
 // ListDatasets lists regular ZFS datasets, i.e. filesystems, volumes and
 // clones. Snapshots are not included, similarly to how they are not included
-// in "zfs list" by default.
-func ListDatasets() ([]ListEntry, error) {
-	lines, err := zfs("list", "-Ho", "name,mountpoint,type")
+// in "zfs list" by default. If roots are given, only they and their
+// descendants are listed, each parent before its children.
+func ListDatasets(roots ...string) ([]ListEntry, error) {
+	args := []string{"list", "-Hpo", "name,used,avail,refer,mountpoint,type"}
+	if len(roots) > 0 {
+		args = append(args, "-t", "filesystem,volume", "-r")
+		args = append(args, roots...)
+	}
+	lines, err := zfs(args...)
 	if err != nil {
 		return nil, err
 	}
@@ -44,41 +62,94 @@ func ListDatasets() ([]ListEntry, error) {
 			continue
 		}
 
-		fields := strings.Fields(string(line))
+		fields := strings.Split(line, "\t")
 		if len(fields) != 6 {
 			return nil, fmt.Errorf("Unparseable line: %#v", line)
 		}
 
-		name := fields[0]
-		mountpoint := fields[1]
-		fstype := fields[2]
-
-		e := ListEntry{Name: name, Mountpoint: mountpoint, Type: fstype}
+		e := ListEntry{Name: fields[0], Mountpoint: fields[4], Type: fields[5]}
+		for i, v := range []*uint64{&e.Used, &e.Avail, &e.Refer} {
+			*v, err = strconv.ParseUint(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("Unparseable line: %#v", line)
+			}
+		}
 		entries = append(entries, e)
 	}
 	return entries, nil
 }
 
-// ListSnapshots lists all ZFS snapshots on the specified dataset.
+// ListSnapshots lists all ZFS snapshots on the specified dataset, oldest
+// first.
 func ListSnapshots(ds string) ([]SnapshotEntry, error) {
-	lines, err := zfs("list", "-Ho", "name,creation", "-t", "snapshot", "-r", "-d", "1", ds)
+	lines, err := zfs("list", "-Hpo", "name,creation,guid,createtxg", "-s", "createtxg", "-t", "snapshot", "-r", "-d", "1", ds)
 	if err != nil {
 		return nil, err
 	}
 
 	entries := make([]SnapshotEntry, 0, len(lines))
 	for _, line := range lines {
-		fields := strings.SplitN(line, "\t", 2)
+		fields := strings.Split(line, "\t")
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Unparseable line: %#v", line)
+		}
 
-		name := fields[0]
-		nameFields := strings.SplitN(name, "@", 2)
-		creation, err := time.Parse("Mon Jan _2 15:04 2006", fields[1])
+		nameFields := strings.SplitN(fields[0], "@", 2)
+		if len(nameFields) != 2 {
+			return nil, fmt.Errorf("Unparseable line: %#v", line)
+		}
+		creation, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		guid, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		txg, err := strconv.ParseUint(fields[3], 10, 64)
 		if err != nil {
 			return nil, err
 		}
 
-		e := SnapshotEntry{Dataset: nameFields[0], Snapshot: nameFields[1], Creation: creation}
+		e := SnapshotEntry{
+			Dataset:   nameFields[0],
+			Snapshot:  nameFields[1],
+			Creation:  time.Unix(creation, 0),
+			GUID:      guid,
+			CreateTxg: txg,
+		}
 		entries = append(entries, e)
 	}
+
+	if len(entries) > 0 {
+		root, status := encryption(ds)
+		for i := range entries {
+			entries[i].EncryptionRoot = root
+			entries[i].KeyStatus = status
+		}
+	}
 	return entries, nil
 }
+
+// encryption returns the encryption root and key status of the dataset,
+// or empty strings if it is not encrypted or zfs does not support
+// encryption.
+func encryption(ds string) (root, status string) {
+	lines, err := zfs("get", "-Hpo", "property,value", "encryptionroot,keystatus", ds)
+	if err != nil {
+		return "", ""
+	}
+	for _, line := range lines {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 || fields[1] == "-" {
+			continue
+		}
+		switch fields[0] {
+		case "encryptionroot":
+			root = fields[1]
+		case "keystatus":
+			status = fields[1]
+		}
+	}
+	return
+}
@@ -0,0 +1,30 @@
+package zfs
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// PoolFeatures returns the state ("disabled", "enabled" or "active") of
+// each feature of the pool, by feature name without the "feature@" prefix.
+func PoolFeatures(pool string) (map[string]string, error) {
+	out, err := exec.Command("zpool", "get", "-Hpo", "property,value", "all", pool).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	features := make(map[string]string)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) == 2 && strings.HasPrefix(fields[0], "feature@") {
+			features[strings.TrimPrefix(fields[0], "feature@")] = fields[1]
+		}
+	}
+	return features, nil
+}
+
+// Pool returns the name of the pool of the dataset.
+func Pool(ds string) string {
+	return strings.SplitN(ds, "/", 2)[0]
+}
@@ -0,0 +1,16 @@
+package zfs
+
+import "strings"
+
+// GetProperty returns the value of the property prop on dataset ds, in
+// parsable (exact) form. Unset properties are returned as "-".
+func GetProperty(ds, prop string) (string, error) {
+	lines, err := zfs("get", "-Hpo", "value", prop, ds)
+	if err != nil {
+		return "", err
+	}
+	if len(lines) == 0 {
+		return "", nil
+	}
+	return strings.TrimSpace(lines[0]), nil
+}
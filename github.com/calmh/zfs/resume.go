@@ -0,0 +1,24 @@
+package zfs
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ResumeTokenSnapshot returns the snapshot that a zfs send resumed with the
+// token sends, as decoded by zfs send -nv.
+func ResumeTokenSnapshot(token string) (string, error) {
+	out, err := exec.Command("zfs", "send", "-nv", "-t", token).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "toname = ") {
+			return strings.TrimPrefix(line, "toname = "), nil
+		}
+	}
+	return "", fmt.Errorf("no snapshot name in resume token")
+}
@@ -11,3 +11,26 @@ func TakeSnapshotRecursive(dataset, name string) error {
 	_, err := zfs("snapshot", "-r", dataset+"@"+name)
 	return err
 }
+
+// DestroySnapshot destroys the snapshot called name of dataset.
+func DestroySnapshot(dataset, name string) error {
+	_, err := zfs("destroy", dataset+"@"+name)
+	return err
+}
+
+// DestroySnapshotRecursive destroys the snapshot called name of dataset and
+// of all its descendents.
+func DestroySnapshotRecursive(dataset, name string) error {
+	_, err := zfs("destroy", "-r", dataset+"@"+name)
+	return err
+}
+
+// TakeSnapshots atomically takes snapshots called name of the datasets.
+func TakeSnapshots(name string, datasets ...string) error {
+	args := []string{"snapshot"}
+	for _, ds := range datasets {
+		args = append(args, ds+"@"+name)
+	}
+	_, err := zfs(args...)
+	return err
+}
@@ -1,14 +1,22 @@
 package zfs
 
 import (
+	"fmt"
 	"io"
 	"os/exec"
 	"strings"
 )
 
+// zfs runs the command and returns its output lines. A failure includes
+// the output, which says what went wrong.
 func zfs(args ...string) (lines []string, err error) {
 	cmd := exec.Command("zfs", args...)
 	bytes, err := cmd.CombinedOutput()
+	if err != nil {
+		if out := strings.TrimSpace(string(bytes)); out != "" {
+			err = fmt.Errorf("%v: %s", err, out)
+		}
+	}
 
 	tmpLines := strings.Split(string(bytes), "\n")
 	lines = make([]string, 0, len(lines))
@@ -20,6 +28,12 @@ func zfs(args ...string) (lines []string, err error) {
 	return
 }
 
+// IsNotExist returns whether the error is that of a zfs command on a
+// dataset that does not exist.
+func IsNotExist(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "dataset does not exist")
+}
+
 func zfsPipe(args ...string) (io.WriteCloser, io.Reader, error) {
 	cmd := exec.Command("zfs", args...)
 	stdin, _ := cmd.StdinPipe()
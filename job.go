@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// A job is the replication of one source dataset to a destination. Jobs are
+// given on the command line or read from a config file, where each section
+// is a job and the keys are the long option names of the fields below:
+//
+//	[data]
+//	source = tank/data
+//	target = backup1:tank/replicated/data
+//	rollback = true
+//	property = canmount=noauto
+//	property = readonly=on
+//
+// Keys of options taking a list may be repeated. Options not given for a
+// job default to those given on the command line.
+type job struct {
+	Name      string
+	Source    string   `long:"source" description:"source dataset, <srcds>[@snapshot] (or <host>:<srcds>[@snapshot] when pulling)"`
+	Target    string   `long:"target" description:"destination, <host>[:dstds] (or <dstds> when pulling)"`
+	Rollback  bool     `long:"rollback" description:"do zfs recv -F"`
+	NoMount   bool     `long:"no-mount" description:"do zfs recv -u"`
+	Recursive bool     `long:"recursive" description:"do zfs send -R"`
+	Children  bool     `long:"children" description:"replicate each descendant dataset separately"`
+	InclChild []string `long:"include-children" description:"replicate only descendants matching the pattern"`
+	ExclChild []string `long:"exclude-children" description:"do not replicate descendants matching the pattern"`
+	Raw       bool     `long:"raw" description:"do zfs send -w"`
+	Bookmark  bool     `long:"bookmark" description:"bookmark each snapshot sent on the source"`
+	Snapshot  bool     `long:"snapshot" description:"take a new snapshot and send it"`
+	SnapName  string   `long:"snapshot-name" description:"name template for new snapshots"`
+	Pull      bool     `long:"pull" description:"pull from the remote source to the local target"`
+	Props     []string `long:"property" description:"do zfs recv -o PROP=VALUE"`
+	Exclude   []string `long:"exclude-property" description:"do zfs recv -x PROP"`
+	SnapIncl  []string `long:"include-snapshots" description:"send only snapshots matching the pattern"`
+	SnapExcl  []string `long:"exclude-snapshots" description:"do not send intermediate snapshots matching the pattern"`
+	Retention retention
+	SendFlags sendFlags
+
+	srcDs    string
+	snapshot string
+	host     string
+	dstDs    string
+	props    recvProps
+	children childFilter
+}
+
+func newJob(source, target string) job {
+	return job{
+		Name:      source,
+		Source:    source,
+		Target:    target,
+		Rollback:  opts.Rollback,
+		NoMount:   opts.NoMount,
+		Recursive: opts.Recursive,
+		Children:  opts.Children,
+		InclChild: append([]string(nil), opts.InclChildren...),
+		ExclChild: append([]string(nil), opts.ExclChildren...),
+		Raw:       opts.Raw,
+		Bookmark:  opts.Bookmark,
+		Snapshot:  opts.Snapshot,
+		SnapName:  opts.SnapshotName,
+		Pull:      opts.Pull,
+		Props:     append([]string(nil), opts.Properties...),
+		Exclude:   append([]string(nil), opts.ExcludeProps...),
+		SnapIncl:  append([]string(nil), opts.IncludeSnaps...),
+		SnapExcl:  append([]string(nil), opts.ExcludeSnaps...),
+		Retention: opts.Retention,
+		SendFlags: opts.SendFlags,
+	}
+}
+
+// parse splits the source and target into their components.
+func (j *job) parse() error {
+	if j.Source == "" || j.Target == "" {
+		return fmt.Errorf("job %s: source and target are required", j.Name)
+	}
+
+	src := j.Source
+	if j.Pull {
+		fs := strings.SplitN(src, ":", 2)
+		if len(fs) != 2 || fs[0] == "" {
+			return fmt.Errorf("job %s: pull source must be <host>:<srcds>[@snapshot]", j.Name)
+		}
+		j.host = fs[0]
+		src = fs[1]
+		j.dstDs = j.Target
+	}
+
+	j.srcDs = src
+	if strings.ContainsRune(src, '@') {
+		fs := strings.SplitN(src, "@", 2)
+		j.srcDs = fs[0]
+		j.snapshot = fs[1]
+	}
+	if j.Snapshot && j.snapshot != "" {
+		return fmt.Errorf("job %s: can not both take a new snapshot and send @%s", j.Name, j.snapshot)
+	}
+	if j.Recursive && j.Children {
+		return fmt.Errorf("job %s: --recursive and --children are mutually exclusive", j.Name)
+	}
+	if j.Recursive && j.Bookmark {
+		return fmt.Errorf("job %s: --bookmark does not work with --recursive, as a replication stream can not be sent from a bookmark; use --children", j.Name)
+	}
+	if (len(j.InclChild) > 0 || len(j.ExclChild) > 0) && !j.Children {
+		return fmt.Errorf("job %s: child filters require --children, as zfs send -R sends every descendant", j.Name)
+	}
+	var err error
+	if j.children.include, err = parsePatterns(j.InclChild); err != nil {
+		return fmt.Errorf("job %s: child pattern: %v", j.Name, err)
+	}
+	if j.children.exclude, err = parsePatterns(j.ExclChild); err != nil {
+		return fmt.Errorf("job %s: child pattern: %v", j.Name, err)
+	}
+	if j.Snapshot && j.Pull {
+		return fmt.Errorf("job %s: can not take snapshots on the remote source when pulling", j.Name)
+	}
+
+	if err := j.Retention.validate(); err != nil {
+		return fmt.Errorf("job %s: %v", j.Name, err)
+	}
+	if err := j.SendFlags.validate(); err != nil {
+		return fmt.Errorf("job %s: %v", j.Name, err)
+	}
+	for _, pat := range append(j.SnapIncl, j.SnapExcl...) {
+		if _, err := path.Match(pat, ""); err != nil {
+			return fmt.Errorf("job %s: snapshot pattern %q: %v", j.Name, pat, err)
+		}
+	}
+	props, err := parseRecvProps(j.Props, j.Exclude)
+	if err != nil {
+		return fmt.Errorf("job %s: %v", j.Name, err)
+	}
+	j.props = props
+
+	if !j.Pull {
+		j.host = j.Target
+		j.dstDs = j.srcDs
+		if strings.ContainsRune(j.host, ':') {
+			fs := strings.SplitN(j.host, ":", 2)
+			j.host = fs[0]
+			j.dstDs = fs[1]
+		}
+	}
+	return nil
+}
+
+// thinned returns whether only some of the intermediate snapshots are
+// sent, as selected by the snapshot patterns.
+func (j *job) thinned() bool {
+	return len(j.SnapIncl) > 0 || len(j.SnapExcl) > 0
+}
+
+// selects returns whether the snapshot is one to send, given the snapshot
+// patterns.
+func (j *job) selects(snap string) bool {
+	for _, pat := range j.SnapExcl {
+		if ok, _ := path.Match(pat, snap); ok {
+			return false
+		}
+	}
+	if len(j.SnapIncl) == 0 {
+		return true
+	}
+	for _, pat := range j.SnapIncl {
+		if ok, _ := path.Match(pat, snap); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// endpoints returns the source and destination endpoints of the job, given
+// the session to its host.
+func (j *job) endpoints(s *session) (src, dst endpoint) {
+	if j.Pull {
+		return s, localHost{}
+	}
+	return localHost{}, s
+}
+
+// loadJobs reads the jobs in the config file, in the order given.
+func loadJobs(file string) ([]job, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	// Each section is parsed as the "job" option group by the flags INI
+	// parser, which only knows about a fixed set of group names and keeps
+	// only the last value of a key. So that keys for options taking a list
+	// may be repeated, the n:th occurrences of each key go in the n:th
+	// pass over the section.
+	lists := listKeys()
+	var names []string
+	var sections [][]*bytes.Buffer
+	var seen map[string]int
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			names = append(names, strings.TrimSpace(line[1:len(line)-1]))
+			sections = append(sections, []*bytes.Buffer{bytes.NewBufferString("[job]\n")})
+			seen = make(map[string]int)
+			continue
+		}
+		if len(sections) == 0 {
+			if line != "" && line[0] != ';' {
+				return nil, fmt.Errorf("%s: option outside of job section: %s", file, line)
+			}
+			continue
+		}
+
+		passes := sections[len(sections)-1]
+		pass := 0
+		if i := strings.IndexByte(line, '='); i > 0 && line[0] != ';' {
+			key := strings.TrimSpace(line[:i])
+			pass = seen[key]
+			seen[key]++
+			if pass > 0 && !lists[key] {
+				return nil, fmt.Errorf("%s: job %s: %s given more than once", file, names[len(names)-1], key)
+			}
+		}
+		if pass == len(passes) {
+			passes = append(passes, bytes.NewBufferString("[job]\n"))
+			sections[len(sections)-1] = passes
+		}
+		fmt.Fprintln(passes[pass], line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+
+	jobs := make([]job, len(sections))
+	for i, passes := range sections {
+		jobs[i] = newJob("", "")
+		jobs[i].Name = names[i]
+
+		p := flags.NewNamedParser("zsync", flags.None)
+		p.AddGroup("job", &jobs[i])
+		for _, pass := range passes {
+			err := p.ParseIni(pass)
+			if err != nil {
+				return nil, fmt.Errorf("%s: job %s: %v", file, names[i], err)
+			}
+		}
+		err = jobs[i].parse()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return jobs, nil
+}
+
+// listKeys returns the job keys for options taking a list, which may be
+// given more than once.
+func listKeys() map[string]bool {
+	keys := make(map[string]bool)
+	t := reflect.TypeOf(job{})
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if long := f.Tag.Get("long"); long != "" && f.Type.Kind() == reflect.Slice {
+			keys[long] = true
+		}
+	}
+	return keys
+}
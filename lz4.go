@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// The lz4 codec compresses each chunk as an LZ4 block: a sequence of
+// literal runs, each followed by a match copying earlier output,
+//
+//	token    byte; literal length << 4 | (match length - 4)
+//	         with 15 in either half meaning more length bytes follow
+//	literals [literal length]byte
+//	offset   uint16, little endian; how far back the match starts
+//
+// the last sequence being only literals. It trades compression ratio for
+// speed, so as to keep up with fast links where gzip does not.
+
+const (
+	lz4MinMatch     = 4
+	lz4HashLog      = 16
+	lz4MaxOffset    = 1<<16 - 1
+	lz4LastLiterals = 5  // the block ends with at least this many literals
+	lz4MatchLimit   = 12 // and no match starts this close to the end
+)
+
+var errLz4Corrupt = errors.New("lz4: corrupt chunk")
+
+type lz4Codec struct {
+	table [1 << lz4HashLog]int32 // position+1 of the last occurrence of a hash
+	buf   []byte                 // decoded chunk, matches referring back into it
+}
+
+func newLz4Codec() codec {
+	return &lz4Codec{}
+}
+
+func lz4Hash(u uint32) uint32 {
+	return (u * 2654435761) >> (32 - lz4HashLog)
+}
+
+func (c *lz4Codec) encode(dst *bytes.Buffer, p []byte) error {
+	for i := range c.table {
+		c.table[i] = 0
+	}
+
+	anchor := 0
+	for i, limit := 0, len(p)-lz4MatchLimit; i < limit; {
+		u := binary.LittleEndian.Uint32(p[i:])
+		h := lz4Hash(u)
+		ref := int(c.table[h]) - 1
+		c.table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(p[ref:]) != u {
+			// Skip faster through data that does not compress.
+			i += 1 + (i-anchor)>>6
+			continue
+		}
+
+		for i > anchor && ref > 0 && p[i-1] == p[ref-1] {
+			i--
+			ref--
+		}
+		n := lz4MinMatch + lz4Extend(p, i+lz4MinMatch, ref+lz4MinMatch, len(p)-lz4LastLiterals)
+
+		lz4Sequence(dst, p[anchor:i], i-ref, n)
+		i += n
+		anchor = i
+	}
+	lz4Sequence(dst, p[anchor:], 0, 0)
+	return nil
+}
+
+// lz4Extend returns how many bytes at p[i:] are the same as at p[ref:],
+// before end.
+func lz4Extend(p []byte, i, ref, end int) int {
+	n := 0
+	for i+n+8 <= end {
+		x := binary.LittleEndian.Uint64(p[i+n:]) ^ binary.LittleEndian.Uint64(p[ref+n:])
+		if x != 0 {
+			return n + bits.TrailingZeros64(x)/8
+		}
+		n += 8
+	}
+	for i+n < end && p[i+n] == p[ref+n] {
+		n++
+	}
+	return n
+}
+
+// lz4Sequence writes the literals followed by a match of n bytes at offset
+// back, or only the literals if offset is zero.
+func lz4Sequence(dst *bytes.Buffer, lit []byte, offset, n int) {
+	var token byte
+	if len(lit) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(lit)) << 4
+	}
+	m := n - lz4MinMatch
+	if offset != 0 {
+		if m >= 15 {
+			token |= 15
+		} else {
+			token |= byte(m)
+		}
+	}
+
+	dst.WriteByte(token)
+	if len(lit) >= 15 {
+		lz4Length(dst, len(lit)-15)
+	}
+	dst.Write(lit)
+	if offset == 0 {
+		return
+	}
+	dst.WriteByte(byte(offset))
+	dst.WriteByte(byte(offset >> 8))
+	if m >= 15 {
+		lz4Length(dst, m-15)
+	}
+}
+
+func lz4Length(dst *bytes.Buffer, n int) {
+	for ; n >= 255; n -= 255 {
+		dst.WriteByte(255)
+	}
+	dst.WriteByte(byte(n))
+}
+
+func (c *lz4Codec) decode(dst *bytes.Buffer, p []byte, max int) error {
+	out := c.buf[:0]
+	for i := 0; i < len(p); {
+		token := p[i]
+		i++
+
+		l := int(token >> 4)
+		if l == 15 {
+			var err error
+			if l, i, err = lz4ReadLength(p, i, l); err != nil {
+				return err
+			}
+		}
+		if l > len(p)-i {
+			return errLz4Corrupt
+		}
+		if l > max-len(out) {
+			return fmt.Errorf("decompressed chunk exceeds the maximum chunk size %d", max)
+		}
+		out = append(out, p[i:i+l]...)
+		i += l
+		if i == len(p) {
+			break
+		}
+
+		if i+2 > len(p) {
+			return errLz4Corrupt
+		}
+		offset := int(p[i]) | int(p[i+1])<<8
+		i += 2
+		if offset == 0 || offset > len(out) {
+			return errLz4Corrupt
+		}
+		n := int(token & 15)
+		if n == 15 {
+			var err error
+			if n, i, err = lz4ReadLength(p, i, n); err != nil {
+				return err
+			}
+		}
+		n += lz4MinMatch
+		if n > max-len(out) {
+			return fmt.Errorf("decompressed chunk exceeds the maximum chunk size %d", max)
+		}
+		start := len(out) - offset
+		if offset >= n {
+			out = append(out, out[start:start+n]...)
+		} else {
+			// The match overlaps what it produces, repeating it.
+			for j := 0; j < n; j++ {
+				out = append(out, out[start+j])
+			}
+		}
+	}
+	c.buf = out
+	dst.Write(out)
+	return nil
+}
+
+// lz4ReadLength adds the length bytes at p[i:] to n.
+func lz4ReadLength(p []byte, i, n int) (int, int, error) {
+	for {
+		if i >= len(p) || n > len(p)*255 {
+			return n, i, errLz4Corrupt
+		}
+		b := p[i]
+		i++
+		n += int(b)
+		if b != 255 {
+			return n, i, nil
+		}
+	}
+}
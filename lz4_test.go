@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+// compressibleData returns data with runs and repetitions at all distances,
+// like much of what zfs sends.
+func compressibleData(n int) []byte {
+	r := rand.New(rand.NewSource(42))
+	var buf bytes.Buffer
+	for buf.Len() < n {
+		switch r.Intn(3) {
+		case 0:
+			buf.Write(bytes.Repeat([]byte{byte(r.Intn(256))}, r.Intn(300)))
+		case 1:
+			if b := buf.Bytes(); len(b) > 0 {
+				start := r.Intn(len(b))
+				buf.Write(append([]byte(nil), b[start:start+r.Intn(len(b)-start)%500]...))
+			}
+		default:
+			lit := make([]byte, r.Intn(40))
+			r.Read(lit)
+			buf.Write(lit)
+		}
+	}
+	return buf.Bytes()[:n]
+}
+
+func lz4RoundTrip(t *testing.T, c codec, data []byte) int {
+	var enc, dec bytes.Buffer
+	if err := c.encode(&enc, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.decode(&dec, enc.Bytes(), len(data)); err != nil {
+		t.Fatalf("%d bytes: %v", len(data), err)
+	}
+	if !bytes.Equal(dec.Bytes(), data) {
+		t.Fatalf("%d bytes: data mismatch", len(data))
+	}
+	return enc.Len()
+}
+
+func TestLz4RoundTrip(t *testing.T) {
+	c := newLz4Codec()
+	for _, n := range []int{0, 1, 4, 12, 13, 17, 100, 65536, 70000, defaultMaxChunk} {
+		lz4RoundTrip(t, c, compressibleData(n))
+		lz4RoundTrip(t, c, randomData(n))
+		lz4RoundTrip(t, c, make([]byte, n))
+	}
+
+	data := compressibleData(defaultMaxChunk)
+	if n := lz4RoundTrip(t, c, data); n > len(data)/2 {
+		t.Errorf("compressed %d bytes to %d", len(data), n)
+	}
+	if n := lz4RoundTrip(t, c, make([]byte, defaultMaxChunk)); n > defaultMaxChunk/200 {
+		t.Errorf("compressed %d zeroes to %d bytes", defaultMaxChunk, n)
+	}
+	if n := lz4RoundTrip(t, c, randomData(defaultMaxChunk)); n > maxWireChunk(defaultMaxChunk) {
+		t.Errorf("expanded %d random bytes to %d, more than the maximum on the wire", defaultMaxChunk, n)
+	}
+}
+
+func TestLz4Max(t *testing.T) {
+	c := newLz4Codec()
+	var enc bytes.Buffer
+	c.encode(&enc, make([]byte, 10000))
+	var dec bytes.Buffer
+	if err := c.decode(&dec, enc.Bytes(), 9999); err == nil {
+		t.Error("decoded a chunk larger than the maximum")
+	}
+}
+
+func TestLz4Garbage(t *testing.T) {
+	// Decoding anything must fail or produce at most max bytes, not panic.
+	c := newLz4Codec()
+	f := func(p []byte) bool {
+		var dec bytes.Buffer
+		err := c.decode(&dec, p, minMaxChunk)
+		return err != nil || dec.Len() <= minMaxChunk
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 10000}); err != nil {
+		t.Error(err)
+	}
+}
@@ -1,17 +1,17 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
 	"encoding/gob"
 	"fmt"
-	"io"
 	"os"
+	"os/exec"
+	"strings"
+	"sync"
 
 	"github.com/jessevdk/go-flags"
 )
 
-const protocolVersion = "zsync/1.0"
-
 type LogLevel int
 
 const (
@@ -28,6 +28,15 @@ const (
 	CmdReceive
 	CmdZfsData
 	CmdResult
+	CmdResumeToken
+	CmdError
+	CmdDestroySnapshots
+	CmdSend
+	CmdListBookmarks
+	CmdCreateBookmark
+	CmdEstimateSend
+	CmdPoolFeatures
+	CmdListDatasets
 )
 
 type Command struct {
@@ -37,60 +46,132 @@ type Command struct {
 }
 
 var opts struct {
-	Verbose     []bool `long:"verbose" short:"v" description:"increase the output verbosity"`
-	Progress    bool   `long:"progress" short:"p" description:"show progress indicator during send"`
-	NoMount     bool   `long:"no-mount" short:"u" description:"do not mount the destination dataset after replication (i.e. do zfs recv -u)"`
-	Rollback    bool   `long:"rollback" short:"F" description:"rollback the destination dataset prior to replication (i.e. do zfs recv -F)"`
-	Recursive   bool   `long:"recursive" short:"R" description:"recursively send snapshots and child datasets (i.e. do zfs send -R)"`
-	BufferMB    int    `long:"buffer" description:"buffer size (send & receive)" value-name:"MB" default:"128"`
-	ZsyncPath   string `long:"zsync-path" default:"zsync" value-name:"PROGRAM" description:"specify the zsync to run on remote machine"`
-	Server      bool   `long:"server"`
-	verbosity   LogLevel
-	bufferBytes int
-	//SetReadOnly      bool   `long:"set-readonly" description:"do zfs set readonly=on on the destination"`
+	Verbose      []bool   `long:"verbose" short:"v" description:"increase the output verbosity"`
+	Progress     bool     `long:"progress" short:"p" description:"show progress indicator during send"`
+	NoMount      bool     `long:"no-mount" short:"u" description:"do not mount the destination dataset after replication (i.e. do zfs recv -u)"`
+	Rollback     bool     `long:"rollback" short:"F" description:"rollback the destination dataset prior to replication (i.e. do zfs recv -F)"`
+	Recursive    bool     `long:"recursive" short:"R" description:"recursively send snapshots and child datasets (i.e. do zfs send -R)"`
+	Children     bool     `long:"children" description:"replicate the source dataset and each of its descendants separately, each incrementally from its own latest common snapshot or in full if it is new"`
+	InclChildren []string `long:"include-children" value-name:"PATTERN" description:"with --children, replicate only the descendants whose name relative to the source matches PATTERN, a glob or a regular expression prefixed by re: (may be repeated)"`
+	ExclChildren []string `long:"exclude-children" value-name:"PATTERN" description:"with --children, do not replicate the descendants whose name relative to the source matches PATTERN, nor theirs (may be repeated)"`
+	Bookmark     bool     `long:"bookmark" description:"bookmark each snapshot sent on the source (not with --recursive), so that the snapshot may be destroyed and the bookmark used as the incremental source of the next run"`
+	Raw          bool     `long:"raw" short:"w" description:"send encrypted datasets as is (i.e. do zfs send -w), so that the destination never needs their keys"`
+	Snapshot     bool     `long:"snapshot" short:"S" description:"take a new snapshot of the source dataset (recursively with -R) and send it"`
+	SnapshotName string   `long:"snapshot-name" value-name:"TEMPLATE" default:"zsync-20060102T150405Z" description:"name of snapshots taken by --snapshot, as a Go time layout (in UTC)"`
+	Pull         bool     `long:"pull" description:"pull snapshots from the remote host instead of pushing to it; the arguments are then <host>:<srcds>[@snapshot] <dstds>"`
+	Properties   []string `long:"property" value-name:"PROP=VALUE" description:"set PROP=VALUE on the destination dataset, overriding the source (i.e. do zfs recv -o; may be repeated), e.g. readonly=on"`
+	ExcludeProps []string `long:"exclude-property" value-name:"PROP" description:"do not receive PROP from the source, so that the destination inherits it (i.e. do zfs recv -x; may be repeated)"`
+	IncludeSnaps []string `long:"include-snapshots" value-name:"PATTERN" description:"send only the snapshots matching the glob PATTERN (may be repeated), each incrementally from the previous one (i.e. do a chain of zfs send -i instead of zfs send -I)"`
+	ExcludeSnaps []string `long:"exclude-snapshots" value-name:"PATTERN" description:"do not send the intermediate snapshots matching the glob PATTERN (may be repeated)"`
+	Retention    retention
+	SendFlags    sendFlags
+	DryRun       bool     `long:"dry-run" short:"n" description:"print what would be sent, with the zfs send and recv arguments and the estimated size, without changing anything"`
+	JSON         bool     `long:"json" description:"write events and a final report of the run to stdout as JSON, one object per line"`
+	Metrics      string   `long:"metrics" value-name:"FILE" description:"after each run, update FILE with metrics of the jobs for the Prometheus node exporter textfile collector"`
+	Config       string   `long:"config" short:"c" value-name:"FILE" description:"run the replication jobs described in FILE"`
+	Resume       bool     `long:"resume" description:"receive resumably (i.e. do zfs recv -s) and resume an interrupted transfer on the next run"`
+	Compress     string   `long:"compress" short:"z" value-name:"none|auto|lz4|gzip" default:"none" description:"compress the stream on the wire; auto picks the fastest the peer supports, lz4 or else gzip"`
+	BufferMB     int      `long:"buffer" description:"buffer size (send & receive)" value-name:"MB" default:"128"`
+	ZsyncPath    string   `long:"zsync-path" default:"zsync" value-name:"PROGRAM" description:"specify the zsync to run on remote machine"`
+	Transport    string   `long:"transport" value-name:"ssh|tcp|tls|local" default:"ssh" description:"how to reach the remote zsync: over ssh, plain TCP to a --listen server, TLS to a --daemon, or in process for copies on this host"`
+	Port         int      `long:"port" description:"port to connect to (ssh or tcp transport)"`
+	Identity     string   `long:"identity" short:"i" value-name:"FILE" description:"ssh identity file"`
+	Cipher       string   `long:"cipher" description:"ssh cipher"`
+	SSHOptions   []string `long:"ssh-option" short:"o" value-name:"OPTION" description:"additional ssh option, in ssh_config format (may be repeated)"`
+	Server       bool     `long:"server"`
+	Restrict     []string `long:"restrict" value-name:"PREFIX" description:"with --server, only permit operations on datasets under PREFIX (may be repeated) and only whitelisted zfs send/recv options, never taking mountpoint or share properties from received streams; for use as an ssh forced command"`
+	Listen       string   `long:"listen" value-name:"ADDR" description:"with --server, accept a single unauthenticated plain TCP connection on ADDR instead of using stdin/stdout, requiring --restrict; with --daemon, accept TLS connections on ADDR"`
+	Daemon       bool     `long:"daemon" description:"run as a long-lived server for TLS clients"`
+	Cert         string   `long:"cert" value-name:"FILE" description:"TLS certificate (tls transport and --daemon)"`
+	Key          string   `long:"key" value-name:"FILE" description:"TLS private key (tls transport and --daemon)"`
+	CACert       string   `long:"ca" value-name:"FILE" description:"CA certificates to verify the TLS peer against"`
+	Authorized   string   `long:"authorized" value-name:"FILE" description:"with --daemon, file of client certificate names and the dataset prefixes they may access"`
+	ForceProps   []string `long:"force-property" value-name:"PROP=VALUE" description:"with --server or --daemon, set PROP=VALUE on every dataset received, whatever the client asks (may be repeated)"`
+	ForceExclude []string `long:"force-exclude-property" value-name:"PROP" description:"with --server or --daemon, exclude PROP from every dataset received, whatever the client asks (may be repeated)"`
+	verbosity    LogLevel
+	bufferBytes  int
 }
 
 func main() {
 	parser := flags.NewParser(&opts, flags.PassDoubleDash|flags.PrintErrors)
-	parser.Usage = "[OPTIONS] <srcds>[@snapshot] <host>[:dstds]"
+	parser.Usage = "[OPTIONS] <srcds>[@snapshot] <host>[:dstds]  |  [OPTIONS] --config FILE"
 	args, err := parser.Parse()
 	opts.verbosity = LogLevel(len(opts.Verbose))
 	opts.bufferBytes = opts.BufferMB * 1024 * 1024
 
-	if err != nil || !opts.Server && len(args) != 2 {
+	serving := opts.Server || opts.Daemon
+	if err != nil || !serving && opts.Config == "" && len(args) != 2 || opts.Config != "" && len(args) != 0 {
 		fmt.Fprintln(os.Stderr)
 		parser.WriteHelp(os.Stderr)
 		fmt.Fprintf(os.Stderr, "\nExample:\n")
 		fmt.Fprintf(os.Stderr, "  %s tank/data 172.16.32.12:tank/replicated\n", parser.ApplicationName)
-		fmt.Fprintf(os.Stderr, "  %s -vpFuR tank/data@snap42 root@remote:tank/data\n\n", parser.ApplicationName)
-		os.Exit(2)
+		fmt.Fprintf(os.Stderr, "  %s -vpFuR tank/data@snap42 root@remote:tank/data\n", parser.ApplicationName)
+		fmt.Fprintf(os.Stderr, "  %s --pull root@production:tank/data backup/production/data\n", parser.ApplicationName)
+		fmt.Fprintf(os.Stderr, "  %s --transport local tank/data :backup/data\n", parser.ApplicationName)
+		fmt.Fprintf(os.Stderr, "  %s -v --config /etc/zsync.conf\n\n", parser.ApplicationName)
+		os.Exit(exitUsage)
 	}
 
+	prefix := "zsync: "
 	if opts.Server {
-		server()
+		prefix = "server: "
+		err = server()
+	} else if opts.Daemon {
+		prefix = "daemon: "
+		err = daemon()
+	} else if opts.Config != "" {
+		var jobs []job
+		jobs, err = loadJobs(opts.Config)
+		if err == nil {
+			err = runJobs(jobs)
+		} else {
+			err = localError(err, "")
+		}
 	} else {
-		client(args[0], args[1])
+		err = client(args[0], args[1])
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
+		if e, ok := err.(*exitError); ok {
+			fmt.Fprint(os.Stderr, e.Detail())
+		}
+		os.Exit(exitCode(err))
 	}
 }
 
-func negotiateVersion(e *gob.Encoder, d *gob.Decoder) {
+// readResult reads the reply to a request, which is either CmdResult or a
+// CmdError that is returned as an error.
+func readResult(d *gob.Decoder) (Command, error) {
 	var c Command
-	c.Command = CmdVersion
-	c.Params = []string{protocolVersion}
-	err := e.Encode(c)
-	panicOn(err)
-	err = d.Decode(&c)
-	if c.Params[0] != protocolVersion {
-		panic(fmt.Errorf("Mismatched protocol version %s != %s", c.Params[0], protocolVersion))
+	err := d.Decode(&c)
+	if err != nil {
+		return c, protocolError(err)
+	}
+	switch c.Command {
+	case CmdResult:
+		return c, nil
+	case CmdError:
+		return c, remoteError(c)
+	default:
+		return c, protocolError(fmt.Errorf("unexpected reply %d", c.Command))
 	}
-	panicOn(err)
 }
 
-func panicOn(e error) {
-	if e != nil {
-		fmt.Fprintf(os.Stderr, "panic: %v\n", e)
-		os.Exit(3)
+// resultWith returns a CmdResult carrying the gob encoding of v as data.
+func resultWith(v interface{}) (Command, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return Command{Command: CmdResult, Data: buf.Bytes()}, err
+}
+
+// decodeData decodes the data of a CmdResult into v.
+func decodeData(c Command, v interface{}) error {
+	err := gob.NewDecoder(bytes.NewReader(c.Data)).Decode(v)
+	if err != nil {
+		return protocolError(err)
 	}
+	return nil
 }
 
 func logf(level LogLevel, format string, args ...interface{}) {
@@ -99,13 +180,56 @@ func logf(level LogLevel, format string, args ...interface{}) {
 	}
 }
 
-func printLines(prefix string, r io.Reader) {
-	br := bufio.NewReader(r)
+const lineLogTail = 10
+
+// A lineLog prints lines written to it on stderr with a prefix and keeps
+// the last few of them, so that the output of a failed command can be
+// included in the error report.
+type lineLog struct {
+	prefix string
+	mut    sync.Mutex
+	buf    []byte
+	tail   []string
+}
+
+func newLineLog(prefix string) *lineLog {
+	return &lineLog{prefix: prefix}
+}
+
+func (l *lineLog) Write(bs []byte) (int, error) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+
+	l.buf = append(l.buf, bs...)
 	for {
-		bs, _, err := br.ReadLine()
-		if err == io.EOF {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
 			break
 		}
-		fmt.Fprintf(os.Stderr, "%s%s\n", prefix, bs)
+		line := string(l.buf[:i])
+		l.buf = l.buf[i+1:]
+
+		fmt.Fprintf(os.Stderr, "%s%s\n", l.prefix, line)
+		l.tail = append(l.tail, line)
+		if len(l.tail) > lineLogTail {
+			l.tail = l.tail[1:]
+		}
+	}
+	return len(bs), nil
+}
+
+// String returns the last lines written.
+func (l *lineLog) String() string {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	return strings.Join(l.tail, "\n")
+}
+
+// reap kills and waits for cmd if it has been started but not waited for,
+// so that no child processes are left behind when bailing out on error.
+func reap(cmd *exec.Cmd) {
+	if cmd.Process != nil && cmd.ProcessState == nil {
+		cmd.Process.Kill()
+		cmd.Wait()
 	}
 }
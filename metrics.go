@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The metrics written by --metrics, in the node exporter textfile format.
+// Each series is labelled with the job, its source and its target. With
+// --children, each dataset of a job also has series of its own, labelled
+// with the source dataset as well.
+var metrics = []struct {
+	name, kind, help string
+}{
+	{"zsync_last_run_timestamp_seconds", "gauge", "Time the last run of the job ended."},
+	{"zsync_last_run_success", "gauge", "Whether the last run of the job succeeded."},
+	{"zsync_last_success_timestamp_seconds", "gauge", "Time the last successful run of the job ended."},
+	{"zsync_transferred_bytes", "gauge", "Bytes sent by zfs in the last run of the job."},
+	{"zsync_duration_seconds", "gauge", "Duration of the last run of the job."},
+	{"zsync_latest_common_snapshot_timestamp_seconds", "gauge", "Creation time of the latest snapshot on both the source and the destination."},
+	{"zsync_failures_total", "counter", "Failed runs of the job."},
+}
+
+// series maps label sets, as written, to the values of the metrics.
+type series map[string]map[string]float64
+
+// writeMetrics updates the metrics file with the results of the jobs.
+// Values that a run can not tell, such as the time of the last success of a
+// failed job, and the failure counts are carried over from the file, as are
+// the series of jobs that were not run.
+func writeMetrics(file string, reports []*jobReport, now time.Time) error {
+	prev, err := readMetrics(file)
+	if err != nil {
+		return err
+	}
+
+	cur := make(series)
+	for _, r := range reports {
+		// The series of the job and of each dataset, by dataset.
+		prefix := `{job="` + escapeLabel(r.Job) + `",`
+		old := make(map[string]map[string]float64)
+		for labels, values := range prev {
+			if strings.HasPrefix(labels, prefix) {
+				old[datasetLabel(labels)] = values
+				delete(prev, labels)
+			}
+		}
+
+		labels := fmt.Sprintf(`{job="%s",source="%s",target="%s"`, escapeLabel(r.Job), escapeLabel(r.Source), escapeLabel(r.Target))
+		cur[labels+"}"] = reportValues(r, old[""], now)
+		for _, cr := range r.Datasets {
+			ds := escapeLabel(cr.Source)
+			cur[labels+`,dataset="`+ds+`"}`] = reportValues(cr, old[ds], now)
+		}
+	}
+	for labels, values := range prev {
+		cur[labels] = values
+	}
+
+	var buf bytes.Buffer
+	cur.write(&buf)
+	return writeFileAtomic(file, buf.Bytes())
+}
+
+// reportValues returns the values of the metrics for a job or dataset,
+// given those of its previous run.
+func reportValues(r *jobReport, old map[string]float64, now time.Time) map[string]float64 {
+	values := map[string]float64{
+		"zsync_last_run_timestamp_seconds": float64(now.Unix()),
+		"zsync_transferred_bytes":          float64(r.Bytes),
+		"zsync_duration_seconds":           r.Seconds,
+		"zsync_failures_total":             old["zsync_failures_total"],
+	}
+	if r.OK {
+		values["zsync_last_run_success"] = 1
+		values["zsync_last_success_timestamp_seconds"] = float64(now.Unix())
+	} else {
+		values["zsync_last_run_success"] = 0
+		values["zsync_failures_total"]++
+		if t, ok := old["zsync_last_success_timestamp_seconds"]; ok {
+			values["zsync_last_success_timestamp_seconds"] = t
+		}
+	}
+	if !r.common.IsZero() {
+		values["zsync_latest_common_snapshot_timestamp_seconds"] = float64(r.common.Unix())
+	} else if t, ok := old["zsync_latest_common_snapshot_timestamp_seconds"]; ok {
+		values["zsync_latest_common_snapshot_timestamp_seconds"] = t
+	}
+	return values
+}
+
+// datasetLabel returns the value, as written, of the dataset label that
+// ends a label set, or "" for the series of a whole job.
+func datasetLabel(labels string) string {
+	const label = `,dataset="`
+	i := strings.LastIndex(labels, label)
+	if i < 0 {
+		return ""
+	}
+	return labels[i+len(label) : len(labels)-2]
+}
+
+func (s series) write(buf *bytes.Buffer) {
+	var labels []string
+	for l := range s {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, m := range metrics {
+		fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+		for _, l := range labels {
+			if v, ok := s[l][m.name]; ok {
+				fmt.Fprintf(buf, "%s%s %s\n", m.name, l, strconv.FormatFloat(v, 'f', -1, 64))
+			}
+		}
+	}
+}
+
+// readMetrics reads the series in a metrics file written earlier. A missing
+// file has none.
+func readMetrics(file string) (series, error) {
+	s := make(series)
+	fd, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	sc := bufio.NewScanner(fd)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		lb := strings.IndexByte(line, '{')
+		sp := strings.LastIndex(line, " ")
+		if lb < 0 || sp < lb {
+			return nil, fmt.Errorf("%s: unparseable line: %q", file, line)
+		}
+		v, err := strconv.ParseFloat(line[sp+1:], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		labels := line[lb:sp]
+		if s[labels] == nil {
+			s[labels] = make(map[string]float64)
+		}
+		s[labels][line[:lb]] = v
+	}
+	return s, sc.Err()
+}
+
+func escapeLabel(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
+
+// writeFileAtomic replaces the file with data by way of a temporary file in
+// the same directory, so that readers never see it half written.
+func writeFileAtomic(file string, data []byte) error {
+	fd, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Chmod(0644)
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), file)
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
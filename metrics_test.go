@@ -0,0 +1,50 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriteMetricsChildren(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "zsync.prom")
+	now := time.Unix(1700000000, 0)
+	report := func(ok bool) *jobReport {
+		r := &jobReport{Job: "web", Source: "tank/web", Target: "backup:tank/web", OK: true, Bytes: 30}
+		r.Datasets = []*jobReport{
+			{Job: "web", Source: "tank/web", Target: "tank/web", OK: true, Bytes: 10},
+			{Job: "web", Source: "tank/web/db", Target: "tank/web/db", OK: ok, Bytes: 20},
+		}
+		return r
+	}
+
+	if err := writeMetrics(file, []*jobReport{report(false)}, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeMetrics(file, []*jobReport{report(false)}, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	labels := `{job="web",source="tank/web",target="backup:tank/web"`
+	for _, line := range []string{
+		`zsync_transferred_bytes` + labels + `} 30`,
+		`zsync_transferred_bytes` + labels + `,dataset="tank/web"} 10`,
+		`zsync_transferred_bytes` + labels + `,dataset="tank/web/db"} 20`,
+		`zsync_failures_total` + labels + `,dataset="tank/web"} 0`,
+		`zsync_failures_total` + labels + `,dataset="tank/web/db"} 2`,
+		`zsync_last_success_timestamp_seconds` + labels + `,dataset="tank/web"} 1700003600`,
+	} {
+		if !strings.Contains(string(data), line+"\n") {
+			t.Errorf("missing %s", line)
+		}
+	}
+	if strings.Contains(string(data), `zsync_last_success_timestamp_seconds`+labels+`,dataset="tank/web/db"}`) {
+		t.Error("tank/web/db never succeeded")
+	}
+}
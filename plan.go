@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A plan is what replicating a job does, as worked out from the snapshots
+// on both sides. With --dry-run it is printed instead of carried out.
+type plan struct {
+	Job         string `json:"job"`
+	Direction   string `json:"direction"`
+	Host        string `json:"host"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Protocol    int    `json:"protocol_version"`
+
+	// Arguments to zfs send resuming an interrupted transfer first.
+	Resume []string `json:"resume_args,omitempty"`
+	// Set if Snapshot is to be taken first.
+	NewSnapshot bool `json:"new_snapshot,omitempty"`
+	// The snapshot to send, if any.
+	Snapshot string `json:"snapshot,omitempty"`
+	// Set if the destination already has Snapshot.
+	InSync bool `json:"in_sync"`
+	// The incremental source, "@snapshot" or "#bookmark", if any.
+	Base string `json:"base,omitempty"`
+	// Arguments to the zfs sends, done in order.
+	Sends    [][]string `json:"sends,omitempty"`
+	RecvArgs []string   `json:"recv_args,omitempty"`
+
+	Estimate      *sendEstimate `json:"estimate,omitempty"`
+	EstimateError string        `json:"estimate_error,omitempty"`
+
+	// Creation times of the latest snapshot in common and of Snapshot.
+	common, creation time.Time
+}
+
+func newPlan(s *session, j job) *plan {
+	p := &plan{
+		Job:         j.Name,
+		Direction:   "push",
+		Host:        j.host,
+		Source:      j.srcDs,
+		Destination: j.dstDs,
+		Protocol:    s.proto.version,
+	}
+	if j.Pull {
+		p.Direction = "pull"
+	}
+	return p
+}
+
+// show estimates the size of the sends on the source and prints the plan,
+// or emits it as an event with --json.
+func (p *plan) show(src endpoint) error {
+	if p.Sends != nil && !p.NewSnapshot {
+		total := &sendEstimate{}
+		for _, args := range p.Sends {
+			est, err := src.estimateSend(args)
+			if err != nil {
+				p.EstimateError = err.Error()
+				total = nil
+				break
+			}
+			total.Streams = append(total.Streams, est.Streams...)
+			total.Size += est.Size
+		}
+		p.Estimate = total
+	}
+
+	if opts.JSON {
+		emit("plan", p.Job, p)
+		return nil
+	}
+	p.print(os.Stdout)
+	return nil
+}
+
+func (p *plan) print(w io.Writer) {
+	sendOn, recvOn := "locally", "on "+p.Host
+	if p.Direction == "pull" {
+		sendOn, recvOn = recvOn, sendOn
+	}
+
+	from, to := p.Source, p.Host+":"+p.Destination
+	if p.Direction == "pull" {
+		from, to = p.Host+":"+p.Source, p.Destination
+	}
+	fmt.Fprintf(w, "%s: %s %s to %s (protocol version %d)\n", p.Job, p.Direction, from, to, p.Protocol)
+	if p.Resume != nil {
+		fmt.Fprintf(w, "  resume an interrupted transfer: zfs send %s\n", strings.Join(p.Resume, " "))
+	}
+	if p.NewSnapshot {
+		fmt.Fprintf(w, "  take snapshot %s@%s\n", p.Source, p.Snapshot)
+	}
+
+	switch {
+	case p.Snapshot == "":
+		fmt.Fprintf(w, "  no snapshot to send\n")
+		return
+	case p.InSync:
+		fmt.Fprintf(w, "  nothing to send; destination has %s@%s\n", p.Source, p.Snapshot)
+		return
+	case p.Base == "" && len(p.Sends) > 1:
+		fmt.Fprintf(w, "  send of %s@%s, starting with a full send\n", p.Source, p.Snapshot)
+	case p.Base == "":
+		fmt.Fprintf(w, "  full send of %s@%s\n", p.Source, p.Snapshot)
+	default:
+		fmt.Fprintf(w, "  incremental send of %s@%s from %s\n", p.Source, p.Snapshot, p.Base)
+	}
+	if len(p.Sends) > 1 {
+		fmt.Fprintf(w, "  %d snapshots, each incrementally from the previous\n", len(p.Sends))
+	}
+	for _, args := range p.Sends {
+		fmt.Fprintf(w, "  %s: zfs send %s\n", sendOn, strings.Join(args, " "))
+	}
+	fmt.Fprintf(w, "  %s: zfs recv %s\n", recvOn, strings.Join(p.RecvArgs, " "))
+
+	switch {
+	case p.Estimate != nil:
+		for _, s := range p.Estimate.Streams {
+			from := ""
+			if s.From != "" {
+				from = s.From + " -> "
+			}
+			fmt.Fprintf(w, "    %s %s%s: %sB\n", s.Type, from, s.To, toSi(int(s.Size)))
+		}
+		fmt.Fprintf(w, "  estimated size %sB\n", toSi(int(p.Estimate.Size)))
+	case p.EstimateError != "":
+		fmt.Fprintf(w, "  size unknown: %s\n", p.EstimateError)
+	default:
+		fmt.Fprintf(w, "  size unknown until the snapshot is taken\n")
+	}
+}
+
+// A sendEstimate is what "zfs send -nvP" expects to send.
+type sendEstimate struct {
+	Streams []estimatedStream `json:"streams"`
+	Size    int64             `json:"size"`
+}
+
+type estimatedStream struct {
+	Type string `json:"type"` // "full" or "incremental"
+	From string `json:"from,omitempty"`
+	To   string `json:"to"`
+	Size int64  `json:"size"`
+}
+
+// estimate runs "zfs send -nvP" with args.
+func estimate(args []string) (sendEstimate, error) {
+	var est sendEstimate
+	params := append([]string{"send", "-nvP"}, args...)
+	out, err := exec.Command("zfs", params...).CombinedOutput()
+	if err != nil {
+		return est, fmt.Errorf("zfs send -nvP: %v: %s", err, bytes.TrimSpace(out))
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch {
+		case fields[0] == "size" && len(fields) == 2:
+			est.Size = size
+		case fields[0] == "full" && len(fields) == 3:
+			est.Streams = append(est.Streams, estimatedStream{Type: "full", To: fields[1], Size: size})
+		case fields[0] == "incremental" && len(fields) == 4:
+			est.Streams = append(est.Streams, estimatedStream{Type: "incremental", From: fields[1], To: fields[2], Size: size})
+		}
+	}
+	return est, nil
+}
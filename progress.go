@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ttyProgressInterval = time.Second
+	logProgressInterval = 30 * time.Second
+)
+
+// progress periodically reports the state of a running transfer on stderr.
+// When stderr is a terminal the report is a single continuously updated
+// line; otherwise a plain log line is printed every logProgressInterval.
+type progress struct {
+	n        int64 // bytes transferred; accessed atomically
+	expected int64 // estimated stream size, or zero if unknown
+	t0       time.Time
+	tty      bool
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+type progressReader struct {
+	io.Reader
+	p *progress
+}
+
+func (r progressReader) Read(bs []byte) (n int, err error) {
+	n, err = r.Reader.Read(bs)
+	atomic.AddInt64(&r.p.n, int64(n))
+	return
+}
+
+func newProgress(expected int64) *progress {
+	p := &progress{
+		expected: expected,
+		t0:       time.Now(),
+		tty:      isTerminal(os.Stderr),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// Reader returns a reader that accounts everything read from r as
+// transferred.
+func (p *progress) Reader(r io.Reader) io.Reader {
+	return progressReader{r, p}
+}
+
+// Stop ends the reporting and, on a terminal, finishes the progress line.
+func (p *progress) Stop() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+
+	interval := logProgressInterval
+	if p.tty {
+		interval = ttyProgressInterval
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	var prevN int64
+	prevT := p.t0
+	for {
+		select {
+		case now := <-t.C:
+			n := atomic.LoadInt64(&p.n)
+			cur := float64(n-prevN) / now.Sub(prevT).Seconds()
+			p.report(n, cur, now)
+			prevN, prevT = n, now
+
+		case <-p.stop:
+			if p.tty {
+				n := atomic.LoadInt64(&p.n)
+				p.report(n, 0, time.Now())
+				fmt.Fprintln(os.Stderr)
+			}
+			return
+		}
+	}
+}
+
+func (p *progress) report(n int64, cur float64, now time.Time) {
+	avg := float64(n) / now.Sub(p.t0).Seconds()
+
+	line := fmt.Sprintf("%sB sent, %sB/s (avg %sB/s)", toSi(int(n)), toSi(int(cur)), toSi(int(avg)))
+	if p.expected > 0 {
+		pct := 100 * float64(n) / float64(p.expected)
+		line += fmt.Sprintf(", %.0f%% of ~%sB", pct, toSi(int(p.expected)))
+		if avg > 0 && n < p.expected {
+			eta := time.Duration(float64(p.expected-n)/avg) * time.Second
+			line += fmt.Sprintf(", ETA %s", eta)
+		}
+	}
+
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r%-78s", line)
+	} else {
+		logf(INFO, "zsync: progress: %s\n", line)
+	}
+}
+
+// estimateSize asks zfs for the expected size of the stream that "zfs send"
+// would produce given the args, by doing a dry run with parsable output.
+func estimateSize(args []string) (int64, error) {
+	est, err := estimate(args)
+	return est.Size, err
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
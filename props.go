@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// recvProps are the properties to override (zfs recv -o) and exclude (zfs
+// recv -x) when receiving, so that the destination may differ from the
+// source. They are sent to the server as the data of CmdReceive.
+type recvProps struct {
+	Set     map[string]string
+	Exclude []string
+}
+
+// parseRecvProps parses PROP=VALUE overrides and PROP exclusions.
+func parseRecvProps(set, exclude []string) (recvProps, error) {
+	var p recvProps
+	for _, s := range set {
+		kv := strings.SplitN(s, "=", 2)
+		if len(kv) != 2 {
+			return p, fmt.Errorf("property override %q is not PROP=VALUE", s)
+		}
+		if p.Set == nil {
+			p.Set = make(map[string]string)
+		}
+		p.Set[kv[0]] = kv[1]
+	}
+	p.Exclude = append(p.Exclude, exclude...)
+	return p, p.validate()
+}
+
+func (p recvProps) empty() bool {
+	return len(p.Set) == 0 && len(p.Exclude) == 0
+}
+
+func (p recvProps) validate() error {
+	for name := range p.Set {
+		if !validPropName(name) {
+			return fmt.Errorf("invalid property name %q", name)
+		}
+	}
+	for _, name := range p.Exclude {
+		if !validPropName(name) {
+			return fmt.Errorf("invalid property name %q", name)
+		}
+		if _, ok := p.Set[name]; ok {
+			return fmt.Errorf("property %s both overridden and excluded", name)
+		}
+	}
+	return nil
+}
+
+func validPropName(name string) bool {
+	if name == "" || name[0] == '-' {
+		return false
+	}
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+		case r == '_', r == ':', r == '.', r == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// args returns the zfs recv options, in a stable order.
+func (p recvProps) args() []string {
+	var names []string
+	for name := range p.Set {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var args []string
+	for _, name := range names {
+		args = append(args, "-o", name+"="+p.Set[name])
+	}
+	for _, name := range p.Exclude {
+		args = append(args, "-x", name)
+	}
+	return args
+}
+
+// merge returns the properties with those of the policy taking precedence.
+func (p recvProps) merge(policy recvProps) recvProps {
+	m := recvProps{Set: make(map[string]string)}
+	forced := make(map[string]bool)
+	for name, value := range policy.Set {
+		m.Set[name] = value
+		forced[name] = true
+	}
+	for _, name := range policy.Exclude {
+		m.Exclude = append(m.Exclude, name)
+		forced[name] = true
+	}
+	for name, value := range p.Set {
+		if !forced[name] {
+			m.Set[name] = value
+		}
+	}
+	for _, name := range p.Exclude {
+		if !forced[name] {
+			m.Exclude = append(m.Exclude, name)
+		}
+	}
+	return m
+}
+
+// encode returns the gob encoding of the properties, or nil if there are
+// none, as servers that do not know about them expect no data.
+func (p recvProps) encode() ([]byte, error) {
+	if p.empty() {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(p)
+	return buf.Bytes(), err
+}
+
+// decodeRecvProps decodes the properties sent with CmdReceive.
+func decodeRecvProps(data []byte) (recvProps, error) {
+	var p recvProps
+	if len(data) == 0 {
+		return p, nil
+	}
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&p)
+	if err != nil {
+		return p, err
+	}
+	return p, p.validate()
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Every version sends protocolMagic as the first parameter of CmdVersion,
+// as version 1 peers require it and ignore anything else. Later versions
+// add a hello as the data of the command.
+const protocolMagic = "zsync/1.0"
+
+// Protocol versions. Version 1 is the original protocol, with listing and
+// receiving snapshots only and no framing checksums. Version 2 replies to
+// every request with CmdResult or CmdError and adds optional capabilities.
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 2
+)
+
+// The optional features of version 2 and later, used only when both ends
+// support them.
+const (
+	capChecksums = "checksums" // CRC32C and SHA-256 in the stream framing
+	capResume    = "resume"    // CmdResumeToken
+	capSend      = "send"      // CmdSend, i.e. pull
+	capDestroy   = "destroy"   // CmdDestroySnapshots
+	capRaw       = "raw"       // zfs send -w, and encryption in listings
+	capBookmarks = "bookmarks" // CmdListBookmarks and CmdCreateBookmark
+	capEstimate  = "estimate"  // CmdEstimateSend
+	capSendFlags = "sendflags" // zfs send -L -e -c -p, and CmdPoolFeatures
+	capProps     = "props"     // recvProps as the data of CmdReceive
+	capDatasets  = "datasets"  // CmdListDatasets
+	capPreflight = "preflight" // CmdReceive accepted or refused before the stream
+)
+
+var capabilities = []string{capBookmarks, capChecksums, capDatasets, capDestroy, capEstimate, capPreflight, capProps, capRaw, capResume, capSend, capSendFlags}
+
+// commandCapabilities are the capabilities required by commands.
+var commandCapabilities = map[CommandIndex]string{
+	CmdResumeToken:      capResume,
+	CmdSend:             capSend,
+	CmdDestroySnapshots: capDestroy,
+	CmdListBookmarks:    capBookmarks,
+	CmdCreateBookmark:   capBookmarks,
+	CmdEstimateSend:     capEstimate,
+	CmdPoolFeatures:     capSendFlags,
+	CmdListDatasets:     capDatasets,
+}
+
+// Version 1 peers read chunks into whatever buffer they have at hand, so
+// keep chunks to the size they have always been sent in.
+const legacyMaxChunk = 32 << 10
+
+// A hello describes what one end of a session supports. Fields may be added
+// freely as gob ignores those it does not know.
+type hello struct {
+	MinVersion   int
+	MaxVersion   int
+	Capabilities []string
+	Compressions []string
+	Compress     string // the compression proposed by the client, or "auto"
+	MaxChunk     int
+}
+
+// A protocol is what the two ends of a session agreed to speak.
+type protocol struct {
+	version      int
+	capabilities map[string]bool
+	stream       streamParams
+}
+
+func (p protocol) has(capability string) bool {
+	return p.capabilities[capability]
+}
+
+// capabilityNames returns the agreed capabilities, sorted.
+func (p protocol) capabilityNames() []string {
+	caps := []string{}
+	for c := range p.capabilities {
+		caps = append(caps, c)
+	}
+	sort.Strings(caps)
+	return caps
+}
+
+func (p protocol) String() string {
+	return fmt.Sprintf("version %d, capabilities [%s], %s compression, %d byte chunks", p.version, strings.Join(p.capabilityNames(), " "), p.stream.compress, p.stream.maxChunk)
+}
+
+// localHello returns what we support, proposing the given compression.
+func localHello(compress string) hello {
+	return hello{
+		MinVersion:   minProtocolVersion,
+		MaxVersion:   maxProtocolVersion,
+		Capabilities: capabilities,
+		Compressions: compressionNames(),
+		Compress:     compress,
+		MaxChunk:     defaultMaxChunk,
+	}
+}
+
+// negotiateVersion exchanges hellos with the peer and returns the protocol
+// agreed. The client proposes a compression; the server proposes none.
+func negotiateVersion(e *gob.Encoder, d *gob.Decoder, compress string) (protocol, error) {
+	ours := localHello(compress)
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(ours)
+	if err != nil {
+		return protocol{}, protocolError(err)
+	}
+	err = e.Encode(Command{Command: CmdVersion, Params: []string{protocolMagic}, Data: buf.Bytes()})
+	if err != nil {
+		return protocol{}, protocolError(err)
+	}
+
+	var c Command
+	err = d.Decode(&c)
+	if err != nil {
+		return protocol{}, protocolError(err)
+	}
+	if c.Command != CmdVersion || len(c.Params) < 1 || c.Params[0] != protocolMagic {
+		return protocol{}, protocolError(fmt.Errorf("not a zsync peer (got %d %v)", c.Command, c.Params))
+	}
+
+	theirs := hello{MinVersion: 1, MaxVersion: 1}
+	if len(c.Data) > 0 {
+		err = decodeData(c, &theirs)
+		if err != nil {
+			return protocol{}, err
+		}
+	}
+	return agree(ours, theirs)
+}
+
+// agree returns the highest protocol version and the capabilities both
+// hellos support.
+func agree(ours, theirs hello) (protocol, error) {
+	var p protocol
+	p.version = ours.MaxVersion
+	if theirs.MaxVersion < p.version {
+		p.version = theirs.MaxVersion
+	}
+	if p.version < ours.MinVersion || p.version < theirs.MinVersion {
+		return p, protocolError(fmt.Errorf("no common protocol version (we support %d-%d, peer %d-%d)", ours.MinVersion, ours.MaxVersion, theirs.MinVersion, theirs.MaxVersion))
+	}
+
+	if p.version == 1 {
+		if ours.Compress != "" && ours.Compress != "none" && ours.Compress != "auto" {
+			return p, protocolError(fmt.Errorf("peer does not support %s compression (only none)", ours.Compress))
+		}
+		p.stream = streamParams{compress: "none", maxChunk: legacyMaxChunk}
+		return p, nil
+	}
+
+	p.capabilities = make(map[string]bool)
+	for _, c := range ours.Capabilities {
+		if contains(theirs.Capabilities, c) {
+			p.capabilities[c] = true
+		}
+	}
+
+	p.stream.checksums = p.has(capChecksums)
+	p.stream.maxChunk = ours.MaxChunk
+	if theirs.MaxChunk < p.stream.maxChunk {
+		p.stream.maxChunk = theirs.MaxChunk
+	}
+	if p.stream.maxChunk < minMaxChunk {
+		return p, protocolError(fmt.Errorf("invalid maximum chunk size %d", theirs.MaxChunk))
+	}
+
+	compress := ours.Compress
+	if compress == "" {
+		compress = theirs.Compress
+	}
+	if compress == "" {
+		compress = "none"
+	}
+	if compress == "auto" {
+		compress = autoCompression(ours.Compressions, theirs.Compressions)
+	}
+	if !contains(ours.Compressions, compress) {
+		return p, protocolError(fmt.Errorf("unsupported compression %q", compress))
+	}
+	if !contains(theirs.Compressions, compress) {
+		return p, protocolError(fmt.Errorf("peer does not support %s compression (only %s)", compress, strings.Join(theirs.Compressions, ", ")))
+	}
+	p.stream.compress = compress
+	return p, nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, e := range ss {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
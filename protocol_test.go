@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestAgreeSameVersion(t *testing.T) {
+	p, err := agree(localHello("gzip"), localHello(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.version != maxProtocolVersion {
+		t.Errorf("version %d, expected %d", p.version, maxProtocolVersion)
+	}
+	for _, c := range capabilities {
+		if !p.has(c) {
+			t.Errorf("missing capability %s", c)
+		}
+	}
+	if p.stream != (streamParams{"gzip", defaultMaxChunk, true}) {
+		t.Errorf("unexpected stream parameters %+v", p.stream)
+	}
+}
+
+func TestAgreeIntersection(t *testing.T) {
+	theirs := hello{
+		MinVersion:   2,
+		MaxVersion:   7,
+		Capabilities: []string{capChecksums, "teleport"},
+		Compressions: []string{"none", "zstd"},
+		MaxChunk:     4096,
+	}
+	p, err := agree(localHello(""), theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.version != maxProtocolVersion {
+		t.Errorf("version %d, expected %d", p.version, maxProtocolVersion)
+	}
+	if len(p.capabilities) != 1 || !p.has(capChecksums) {
+		t.Errorf("capabilities %v, expected only %s", p.capabilities, capChecksums)
+	}
+	if p.stream != (streamParams{"none", 4096, true}) {
+		t.Errorf("unexpected stream parameters %+v", p.stream)
+	}
+
+	if _, err := agree(localHello("gzip"), theirs); err == nil {
+		t.Error("agreed on a compression the peer does not support")
+	}
+}
+
+func TestAgreeAuto(t *testing.T) {
+	// The client proposes the fastest codec; both sides agree on the same,
+	// falling back to gzip with a peer without lz4.
+	for _, c := range []struct {
+		compressions []string
+		expected     string
+	}{
+		{compressionNames(), "lz4"},
+		{[]string{"none", "gzip"}, "gzip"},
+		{[]string{"none"}, "none"},
+	} {
+		theirs := localHello("")
+		theirs.Compressions = c.compressions
+		client, err := agree(localHello("auto"), theirs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := agree(theirs, localHello("auto"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if client.stream.compress != c.expected || server.stream.compress != c.expected {
+			t.Errorf("%v: agreed on %s and %s, expected %s", c.compressions, client.stream.compress, server.stream.compress, c.expected)
+		}
+	}
+}
+
+func TestAgreeNoCommonVersion(t *testing.T) {
+	theirs := localHello("")
+	theirs.MinVersion = maxProtocolVersion + 1
+	theirs.MaxVersion = maxProtocolVersion + 2
+	if _, err := agree(localHello(""), theirs); err == nil {
+		t.Error("agreed with a peer supporting only newer versions")
+	}
+}
+
+// negotiateWith runs our side of the handshake against the given reply,
+// returning the agreed protocol and what we sent.
+func negotiateWith(t *testing.T, reply interface{}, compress string) (protocol, Command, error) {
+	var in, out bytes.Buffer
+	if err := gob.NewEncoder(&in).Encode(reply); err != nil {
+		t.Fatal(err)
+	}
+	p, err := negotiateVersion(gob.NewEncoder(&out), gob.NewDecoder(&in), compress)
+
+	var sent Command
+	if derr := gob.NewDecoder(&out).Decode(&sent); derr != nil {
+		t.Fatal(derr)
+	}
+	return p, sent, err
+}
+
+func TestNegotiateVersion1Peer(t *testing.T) {
+	v1 := Command{Command: CmdVersion, Params: []string{"zsync/1.0"}}
+
+	p, sent, err := negotiateWith(t, v1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent.Params) == 0 || sent.Params[0] != "zsync/1.0" {
+		t.Errorf("sent %v, which a version 1 peer rejects", sent.Params)
+	}
+	if p.version != 1 || len(p.capabilities) != 0 {
+		t.Errorf("agreed %v with a version 1 peer", p)
+	}
+	if p.stream.checksums || p.stream.compress != "none" {
+		t.Errorf("unexpected stream parameters %+v", p.stream)
+	}
+
+	if _, _, err := negotiateWith(t, v1, "gzip"); err == nil {
+		t.Error("agreed on compression with a version 1 peer")
+	}
+}
+
+func TestNegotiateNewerPeer(t *testing.T) {
+	// A later version may add fields to its hello.
+	type newerHello struct {
+		MinVersion   int
+		MaxVersion   int
+		Capabilities []string
+		Compressions []string
+		MaxChunk     int
+		Something    map[string]int
+	}
+	var data bytes.Buffer
+	gob.NewEncoder(&data).Encode(newerHello{
+		MinVersion:   1,
+		MaxVersion:   9,
+		Capabilities: []string{capResume, capSend, "later"},
+		Compressions: []string{"gzip", "none", "later"},
+		MaxChunk:     8 << 20,
+		Something:    map[string]int{"x": 1},
+	})
+	reply := Command{Command: CmdVersion, Params: []string{"zsync/1.0"}, Data: data.Bytes()}
+
+	p, _, err := negotiateWith(t, reply, "gzip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.version != maxProtocolVersion || !p.has(capResume) || !p.has(capSend) || p.has(capChecksums) {
+		t.Errorf("agreed %v", p)
+	}
+	if p.stream != (streamParams{"gzip", defaultMaxChunk, false}) {
+		t.Errorf("unexpected stream parameters %+v", p.stream)
+	}
+}
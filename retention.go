@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/calmh/zfs"
+)
+
+// A retention policy selects which of the snapshots whose names start with
+// Prefix to keep; all other snapshots with the prefix are destroyed when
+// pruning. Snapshots without the prefix are never touched.
+type retention struct {
+	PruneSource bool          `long:"prune-source" description:"destroy source snapshots not kept by the retention policy"`
+	PruneDest   bool          `long:"prune-destination" description:"destroy destination snapshots not kept by the retention policy"`
+	Prefix      string        `long:"keep-prefix" value-name:"PREFIX" description:"apply the retention policy to snapshots named PREFIX*"`
+	Last        int           `long:"keep-last" value-name:"N" description:"keep the N latest snapshots"`
+	Hourly      int           `long:"keep-hourly" value-name:"N" description:"keep the latest snapshot of each of the N latest hours"`
+	Daily       int           `long:"keep-daily" value-name:"N" description:"keep the latest snapshot of each of the N latest days"`
+	Weekly      int           `long:"keep-weekly" value-name:"N" description:"keep the latest snapshot of each of the N latest weeks"`
+	Monthly     int           `long:"keep-monthly" value-name:"N" description:"keep the latest snapshot of each of the N latest months"`
+	Within      time.Duration `long:"keep-within" value-name:"DURATION" description:"keep snapshots younger than DURATION (e.g. 48h)"`
+}
+
+func (r retention) enabled() bool {
+	return r.PruneSource || r.PruneDest
+}
+
+func (r retention) validate() error {
+	if !r.enabled() {
+		return nil
+	}
+	if r.Prefix == "" {
+		return fmt.Errorf("pruning requires a snapshot name prefix (--keep-prefix)")
+	}
+	if r.Last <= 0 && r.Hourly <= 0 && r.Daily <= 0 && r.Weekly <= 0 && r.Monthly <= 0 && r.Within <= 0 {
+		return fmt.Errorf("pruning requires at least one --keep-* rule")
+	}
+	return nil
+}
+
+// prune returns the snapshots not kept by the policy, oldest first. The
+// snapshots must be ordered oldest first, as listed by zfs. The snapshot
+// named protect is always kept.
+func (r retention) prune(snaps []zfs.SnapshotEntry, now time.Time, protect string) []zfs.SnapshotEntry {
+	keep := make(map[string]bool)
+	keep[protect] = true
+
+	buckets := []struct {
+		n   int
+		key func(time.Time) string
+	}{
+		{r.Hourly, func(t time.Time) string { return t.Format("2006010215") }},
+		{r.Daily, func(t time.Time) string { return t.Format("20060102") }},
+		{r.Weekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		}},
+		{r.Monthly, func(t time.Time) string { return t.Format("200601") }},
+	}
+	seen := make([]map[string]bool, len(buckets))
+	for i := range seen {
+		seen[i] = make(map[string]bool)
+	}
+
+	var candidates []zfs.SnapshotEntry
+	last := 0
+	for i := len(snaps) - 1; i >= 0; i-- {
+		s := snaps[i]
+		if !strings.HasPrefix(s.Snapshot, r.Prefix) {
+			continue
+		}
+		candidates = append(candidates, s)
+
+		if last < r.Last {
+			keep[s.Snapshot] = true
+			last++
+		}
+		if r.Within > 0 && now.Sub(s.Creation) < r.Within {
+			keep[s.Snapshot] = true
+		}
+		for j, b := range buckets {
+			k := b.key(s.Creation)
+			if len(seen[j]) < b.n && !seen[j][k] {
+				seen[j][k] = true
+				keep[s.Snapshot] = true
+			}
+		}
+	}
+
+	var destroy []zfs.SnapshotEntry
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if !keep[candidates[i].Snapshot] {
+			destroy = append(destroy, candidates[i])
+		}
+	}
+	return destroy
+}
+
+func snapshotNames(snaps []zfs.SnapshotEntry) []string {
+	names := make([]string, len(snaps))
+	for i, s := range snaps {
+		names[i] = s.Snapshot
+	}
+	return names
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/calmh/zfs"
+)
+
+// testSnapshots returns snapshots "auto-<time>" taken at the given times,
+// oldest first.
+func testSnapshots(times ...string) []zfs.SnapshotEntry {
+	var snaps []zfs.SnapshotEntry
+	for i, ts := range times {
+		t, err := time.Parse("2006-01-02 15:04", ts)
+		if err != nil {
+			panic(err)
+		}
+		snaps = append(snaps, zfs.SnapshotEntry{Dataset: "tank/a", Snapshot: "auto-" + ts, Creation: t, GUID: uint64(i + 1)})
+	}
+	return snaps
+}
+
+func TestRetentionPrune(t *testing.T) {
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		r       retention
+		snaps   []zfs.SnapshotEntry
+		destroy []string
+	}{
+		{
+			"last",
+			retention{Prefix: "auto-", Last: 2},
+			testSnapshots("2024-03-10 08:00", "2024-03-10 09:00", "2024-03-10 10:00", "2024-03-10 11:00"),
+			[]string{"auto-2024-03-10 08:00", "auto-2024-03-10 09:00"},
+		},
+		{
+			"hourly",
+			retention{Prefix: "auto-", Hourly: 2},
+			testSnapshots("2024-03-10 09:05", "2024-03-10 10:05", "2024-03-10 10:30", "2024-03-10 11:10", "2024-03-10 11:50"),
+			[]string{"auto-2024-03-10 09:05", "auto-2024-03-10 10:05", "auto-2024-03-10 11:10"},
+		},
+		{
+			"daily",
+			retention{Prefix: "auto-", Daily: 2},
+			testSnapshots("2024-03-07 10:00", "2024-03-08 10:00", "2024-03-08 20:00", "2024-03-09 10:00", "2024-03-09 20:00"),
+			[]string{"auto-2024-03-07 10:00", "auto-2024-03-08 10:00", "auto-2024-03-09 10:00"},
+		},
+		{
+			// 2024-02-19 and 2024-02-25 are the Monday and Sunday of ISO
+			// week 8.
+			"weekly",
+			retention{Prefix: "auto-", Weekly: 2},
+			testSnapshots("2024-02-12 10:00", "2024-02-19 10:00", "2024-02-25 10:00", "2024-02-26 10:00"),
+			[]string{"auto-2024-02-12 10:00", "auto-2024-02-19 10:00"},
+		},
+		{
+			"monthly",
+			retention{Prefix: "auto-", Monthly: 2},
+			testSnapshots("2024-01-05 10:00", "2024-01-25 10:00", "2024-02-01 10:00", "2024-02-28 10:00", "2024-03-01 10:00"),
+			[]string{"auto-2024-01-05 10:00", "auto-2024-01-25 10:00", "auto-2024-02-01 10:00"},
+		},
+		{
+			"combined",
+			retention{Prefix: "auto-", Last: 1, Daily: 2, Monthly: 2},
+			testSnapshots("2024-01-05 10:00", "2024-02-01 10:00", "2024-03-08 10:00", "2024-03-09 10:00", "2024-03-09 20:00", "2024-03-10 10:00"),
+			[]string{"auto-2024-01-05 10:00", "auto-2024-03-08 10:00", "auto-2024-03-09 10:00"},
+		},
+		{
+			"within",
+			retention{Prefix: "auto-", Within: 48 * time.Hour},
+			testSnapshots("2024-03-07 12:00", "2024-03-08 11:00", "2024-03-08 13:00", "2024-03-10 11:00"),
+			[]string{"auto-2024-03-07 12:00", "auto-2024-03-08 11:00"},
+		},
+		{
+			"none kept",
+			retention{Prefix: "auto-", Within: time.Hour},
+			testSnapshots("2024-03-07 12:00", "2024-03-08 11:00"),
+			[]string{"auto-2024-03-07 12:00", "auto-2024-03-08 11:00"},
+		},
+		{
+			"other prefix",
+			retention{Prefix: "hourly-", Last: 1},
+			testSnapshots("2024-03-07 12:00", "2024-03-08 11:00"),
+			nil,
+		},
+	}
+
+	for _, c := range cases {
+		destroy := snapshotNames(c.r.prune(c.snaps, now, ""))
+		if len(destroy) == 0 {
+			destroy = nil
+		}
+		if !reflect.DeepEqual(destroy, c.destroy) {
+			t.Errorf("%s: destroy %q, expected %q", c.name, destroy, c.destroy)
+		}
+	}
+}
+
+func TestRetentionPrefix(t *testing.T) {
+	snaps := testSnapshots("2024-03-07 12:00", "2024-03-08 12:00", "2024-03-09 12:00")
+	snaps = append(snaps[:1], append([]zfs.SnapshotEntry{{Dataset: "tank/a", Snapshot: "manual"}}, snaps[1:]...)...)
+	snaps = append(snaps, zfs.SnapshotEntry{Dataset: "tank/a", Snapshot: "manual-2"})
+
+	r := retention{Prefix: "auto-", Last: 1}
+	destroy := snapshotNames(r.prune(snaps, time.Now(), ""))
+	expected := []string{"auto-2024-03-07 12:00", "auto-2024-03-08 12:00"}
+	if !reflect.DeepEqual(destroy, expected) {
+		t.Errorf("destroy %q, expected %q", destroy, expected)
+	}
+}
+
+func TestRetentionProtect(t *testing.T) {
+	snaps := testSnapshots("2024-03-07 12:00", "2024-03-08 12:00", "2024-03-09 12:00")
+	r := retention{Prefix: "auto-", Last: 1}
+	destroy := snapshotNames(r.prune(snaps, time.Now(), "auto-2024-03-07 12:00"))
+	expected := []string{"auto-2024-03-08 12:00"}
+	if !reflect.DeepEqual(destroy, expected) {
+		t.Errorf("destroy %q, expected %q", destroy, expected)
+	}
+}
+
+// A fakeEndpoint has snapshots and bookmarks and records what is destroyed.
+type fakeEndpoint struct {
+	endpoint
+	snapshots []zfs.SnapshotEntry
+	bookmarks []zfs.BookmarkEntry
+	destroyed []string
+}
+
+func (e *fakeEndpoint) String() string {
+	return "fake"
+}
+
+func (e *fakeEndpoint) listSnapshots(ds string) ([]zfs.SnapshotEntry, error) {
+	return e.snapshots, nil
+}
+
+func (e *fakeEndpoint) listBookmarks(ds string) ([]zfs.BookmarkEntry, error) {
+	return e.bookmarks, nil
+}
+
+func (e *fakeEndpoint) destroySnapshots(ds string, recursive bool, names []string) error {
+	e.destroyed = append(e.destroyed, names...)
+	return nil
+}
+
+func TestPruneBookmarkProtects(t *testing.T) {
+	snaps := testSnapshots("2024-03-07 12:00", "2024-03-08 12:00", "2024-03-09 12:00")
+	// The destination has only the oldest snapshot, which is the latest in
+	// common.
+	common := snaps[0]
+
+	cases := []struct {
+		name      string
+		bookmarks []zfs.BookmarkEntry
+		recursive bool
+		destroyed []string
+	}{
+		{"no bookmark", nil, false, []string{"auto-2024-03-08 12:00"}},
+		{"bookmark", []zfs.BookmarkEntry{{Dataset: "tank/a", Bookmark: "b", GUID: common.GUID}}, false, []string{"auto-2024-03-07 12:00", "auto-2024-03-08 12:00"}},
+		{"other bookmark", []zfs.BookmarkEntry{{Dataset: "tank/a", Bookmark: "b", GUID: 42}}, false, []string{"auto-2024-03-08 12:00"}},
+		{"recursive", []zfs.BookmarkEntry{{Dataset: "tank/a", Bookmark: "b", GUID: common.GUID}}, true, []string{"auto-2024-03-08 12:00"}},
+	}
+	for _, c := range cases {
+		src := &fakeEndpoint{snapshots: snaps, bookmarks: c.bookmarks}
+		dst := &fakeEndpoint{snapshots: []zfs.SnapshotEntry{common}}
+		j := job{srcDs: "tank/a", dstDs: "tank/a", Recursive: c.recursive}
+		j.Retention = retention{PruneSource: true, PruneDest: true, Prefix: "auto-", Last: 1}
+
+		if err := prune(src, dst, j); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(src.destroyed, c.destroyed) {
+			t.Errorf("%s: destroyed %q on the source, expected %q", c.name, src.destroyed, c.destroyed)
+		}
+		if len(dst.destroyed) != 0 {
+			t.Errorf("%s: destroyed the common snapshot %q on the destination", c.name, dst.destroyed)
+		}
+	}
+}
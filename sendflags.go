@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// sendFlags select the zfs send options that preserve properties of the
+// source blocks in the stream, rather than converting them to what any
+// receiver understands. A preset selects a set of them at once.
+type sendFlags struct {
+	Preset      string `long:"send-preset" value-name:"plain|native|full" description:"set of zfs send stream options: plain (none), native (-L -e -c, preserving recordsize and on-disk compression) or full (native and -p)"`
+	LargeBlocks bool   `long:"large-block" short:"L" description:"send records larger than 128K as is (i.e. do zfs send -L)"`
+	Embed       bool   `long:"embed" short:"e" description:"send embedded data blocks as is (i.e. do zfs send -e)"`
+	Compressed  bool   `long:"compressed" description:"send compressed blocks without decompressing them (i.e. do zfs send -c)"`
+	Props       bool   `long:"props" description:"include the dataset properties in the stream (i.e. do zfs send -p)"`
+}
+
+var sendPresets = map[string]sendFlags{
+	"":       {},
+	"plain":  {},
+	"native": {LargeBlocks: true, Embed: true, Compressed: true},
+	"full":   {LargeBlocks: true, Embed: true, Compressed: true, Props: true},
+}
+
+// sendFlagFeatures are the pool features the destination needs to receive a
+// stream sent with a flag.
+var sendFlagFeatures = map[string]string{
+	"-L": "large_blocks",
+	"-e": "embedded_data",
+	"-c": "lz4_compress",
+}
+
+func (f sendFlags) validate() error {
+	if _, ok := sendPresets[f.Preset]; !ok {
+		var names []string
+		for name := range sendPresets {
+			if name != "" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown send preset %q (available: %v)", f.Preset, names)
+	}
+	return nil
+}
+
+// args returns the zfs send options selected by the preset and the flags.
+func (f sendFlags) args() []string {
+	p := sendPresets[f.Preset]
+	var args []string
+	if f.LargeBlocks || p.LargeBlocks {
+		args = append(args, "-L")
+	}
+	if f.Embed || p.Embed {
+		args = append(args, "-e")
+	}
+	if f.Compressed || p.Compressed {
+		args = append(args, "-c")
+	}
+	if f.Props || p.Props {
+		args = append(args, "-p")
+	}
+	return args
+}
+
+// checkFeatures returns an error unless the pool, with the given features,
+// can receive a stream sent with args.
+func checkFeatures(pool string, features map[string]string, args []string) error {
+	for _, arg := range args {
+		feature, ok := sendFlagFeatures[arg]
+		if !ok {
+			continue
+		}
+		switch features[feature] {
+		case "enabled", "active":
+		case "":
+			return fmt.Errorf("pool %s does not support feature %s, required by zfs send %s", pool, feature, arg)
+		default:
+			return fmt.Errorf("pool %s has feature %s %s, required by zfs send %s", pool, feature, features[feature], arg)
+		}
+	}
+	return nil
+}
@@ -3,79 +3,366 @@ package main
 import (
 	"bufio"
 	"encoding/gob"
+	"fmt"
 	"io"
+	"net"
 	"os"
-	"os/exec"
+	"strconv"
 
 	"github.com/calmh/zfs"
 )
 
-func server() {
-	bstdin := bufio.NewReader(os.Stdin)
-	e := gob.NewEncoder(os.Stdout)
-	d := gob.NewDecoder(bstdin)
+func server() error {
+	var acl *access
+	if len(opts.Restrict) > 0 {
+		acl = &access{"client", opts.Restrict}
+		logf(VERBOSE, "server: restricted to %v\n", opts.Restrict)
+	}
 
-	negotiateVersion(e, d)
+	if opts.Listen == "" {
+		return serve(os.Stdin, os.Stdout, acl)
+	}
 
-	logf(VERBOSE, "server: starting up\n")
+	// Serve a single plain TCP connection, as if it was stdin/stdout. As
+	// anyone that can connect gets to use it, it must be restricted.
+	if acl == nil {
+		return localError(fmt.Errorf("--listen requires --restrict, as the connection is not authenticated"), "")
+	}
+	ln, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		return localError(err, "")
+	}
+	logf(VERBOSE, "server: listening on %s\n", ln.Addr())
+	c, err := ln.Accept()
+	ln.Close()
+	if err != nil {
+		return localError(err, "")
+	}
+	defer c.Close()
+	logf(VERBOSE, "server: connection from %s\n", c.RemoteAddr())
+	return serve(c, c, acl)
+}
 
-	var c Command
+// serve runs the server side of the protocol on the stream, permitting
+// the operations allowed by the access policy.
+func serve(r io.Reader, w io.Writer, acl *access) error {
+	policy, perr := parseRecvProps(opts.ForceProps, opts.ForceExclude)
+	if perr != nil {
+		return localError(perr, "")
+	}
+	policy = acl.recvPolicy(policy)
+
+	br := bufio.NewReader(r)
+	e := gob.NewEncoder(w)
+	d := gob.NewDecoder(br)
+
+	p, err := negotiateVersion(e, d, "")
+	if err != nil {
+		return err
+	}
+	sp := p.stream
+
+	logf(VERBOSE, "server: starting up\n")
+	logf(DEBUG, "server: protocol %v\n", p)
 
 	for {
+		var c Command
 		err := d.Decode(&c)
 		if err == io.EOF {
-			break
+			return nil
+		}
+		if err != nil {
+			return protocolError(err)
+		}
+
+		if len(c.Params) == 0 && c.Command != CmdVersion {
+			err = e.Encode(errorCommand(fmt.Errorf("command %d: missing parameters", c.Command)))
+			if err != nil {
+				return protocolError(err)
+			}
+			continue
+		}
+
+		if cap, ok := commandCapabilities[c.Command]; ok && !p.has(cap) {
+			err = e.Encode(errorCommand(fmt.Errorf("command %d requires the %s capability, not agreed", c.Command, cap)))
+			if err != nil {
+				return protocolError(err)
+			}
+			continue
+		}
+
+		if aerr := acl.check(c); aerr != nil {
+			logf(INFO, "server: denied: %v\n", aerr)
+			switch c.Command {
+			case CmdReceive:
+				err = refuseReceive(e, br, p, aerr)
+				if err != nil {
+					return err
+				}
+				continue
+			case CmdSend:
+				// The client expects a stream before the reply; send an
+				// empty one.
+				cw, err := sp.writer(w)
+				if err == nil {
+					err = cw.Flush()
+				}
+				if err != nil {
+					return protocolError(err)
+				}
+			}
+			err = e.Encode(errorCommand(aerr))
+			if err != nil {
+				return protocolError(err)
+			}
+			continue
 		}
-		panicOn(err)
 
 		switch c.Command {
 		case CmdListSnapshots:
 			logf(DEBUG, "server: listing snapshots\n")
-			s, _ := zfs.ListSnapshots(c.Params[0])
-			err = e.Encode(s)
-			panicOn(err)
+			// A dataset that does not exist has no snapshots, as when
+			// receiving it for the first time.
+			s, lerr := zfs.ListSnapshots(c.Params[0])
+			if zfs.IsNotExist(lerr) {
+				s, lerr = nil, nil
+			}
+			if lerr != nil {
+				lerr = fmt.Errorf("listing snapshots of %s: %v", c.Params[0], lerr)
+				logf(INFO, "server: %v\n", lerr)
+			}
+			if p.version < 2 {
+				// Version 1 expects the bare list, and can not be told
+				// about errors.
+				err = e.Encode(s)
+				break
+			}
+			if lerr != nil {
+				err = e.Encode(errorCommand(lerr))
+				break
+			}
+			var res Command
+			res, err = resultWith(s)
+			if err == nil {
+				err = e.Encode(res)
+			}
+
+		case CmdResumeToken:
+			logf(DEBUG, "server: getting resume token\n")
+			token, gerr := zfs.GetProperty(c.Params[0], "receive_resume_token")
+			if gerr != nil || token == "-" {
+				token = ""
+			}
+			err = e.Encode(Command{Command: CmdResult, Params: []string{token}})
 
 		case CmdReceive:
-			logf(DEBUG, "server: zfs recv %v\n", c.Params)
-			receive(c, e, bstdin)
+			err = receive(c, e, br, p, policy)
+
+		case CmdSend:
+			logf(DEBUG, "server: zfs send %v\n", c.Params)
+			err = send(c, e, w, sp)
+
+		case CmdDestroySnapshots:
+			logf(DEBUG, "server: destroying snapshots %v\n", c.Params)
+			err = destroySnapshots(c, e)
+
+		case CmdListBookmarks:
+			logf(DEBUG, "server: listing bookmarks\n")
+			b, lerr := zfs.ListBookmarks(c.Params[0])
+			if zfs.IsNotExist(lerr) {
+				b, lerr = nil, nil
+			}
+			if lerr != nil {
+				err = e.Encode(errorCommand(fmt.Errorf("listing bookmarks of %s: %v", c.Params[0], lerr)))
+				break
+			}
+			var res Command
+			res, err = resultWith(b)
+			if err == nil {
+				err = e.Encode(res)
+			}
+
+		case CmdCreateBookmark:
+			logf(DEBUG, "server: creating bookmark %v\n", c.Params)
+			err = createBookmark(c, e)
+
+		case CmdEstimateSend:
+			logf(DEBUG, "server: estimating zfs send %v\n", c.Params)
+			est, eerr := estimate(c.Params)
+			if eerr != nil {
+				err = e.Encode(errorCommand(eerr))
+				break
+			}
+			var res Command
+			res, err = resultWith(est)
+			if err == nil {
+				err = e.Encode(res)
+			}
+
+		case CmdListDatasets:
+			logf(DEBUG, "server: listing datasets\n")
+			datasets, lerr := zfs.ListDatasets(c.Params[0])
+			if lerr != nil {
+				err = e.Encode(errorCommand(fmt.Errorf("listing datasets under %s: %v", c.Params[0], lerr)))
+				break
+			}
+			var res Command
+			res, err = resultWith(datasets)
+			if err == nil {
+				err = e.Encode(res)
+			}
+
+		case CmdPoolFeatures:
+			logf(DEBUG, "server: getting pool features\n")
+			pool := zfs.Pool(c.Params[0])
+			features, ferr := zfs.PoolFeatures(pool)
+			if ferr != nil {
+				err = e.Encode(errorCommand(fmt.Errorf("getting features of pool %s: %v", pool, ferr)))
+				break
+			}
+			var res Command
+			res, err = resultWith(features)
+			if err == nil {
+				err = e.Encode(res)
+			}
+
+		default:
+			err = e.Encode(errorCommand(fmt.Errorf("unknown command %d", c.Command)))
+		}
+
+		if err != nil {
+			if _, ok := err.(*exitError); ok {
+				return err
+			}
+			return protocolError(err)
 		}
 	}
 }
 
-func receive(c Command, e *gob.Encoder, in io.Reader) {
-	args := []string{"recv"}
-	args = append(args, c.Params...)
-	cmd := exec.Command("zfs", args...)
-
-	recvIn, err := cmd.StdinPipe()
-	panicOn(err)
+// receive runs "zfs recv" on the chunked stream following the command and
+// replies with CmdResult, carrying the verified checksum, or CmdError. The
+// properties requested by the client are overridden and excluded, subject to
+// the policy. With the preflight capability the stream is first accepted
+// with an empty CmdResult. An error is returned only when the stream itself
+// is broken and the session can not continue.
+func receive(c Command, e *gob.Encoder, in io.Reader, p protocol, policy recvProps) error {
+	sp := p.stream
+	props, err := decodeRecvProps(c.Data)
+	if err != nil {
+		err = fmt.Errorf("receive properties: %v", err)
+		logf(INFO, "server: %v\n", err)
+		return refuseReceive(e, in, p, err)
+	}
+	if p.has(capPreflight) {
+		if err := e.Encode(Command{Command: CmdResult}); err != nil {
+			return protocolError(err)
+		}
+	}
 
-	recvErr, err := cmd.StderrPipe()
-	panicOn(err)
-	go printLines("zfs recv: ", recvErr)
+	cr, err := sp.reader(in)
+	if err != nil {
+		return protocolError(err)
+	}
+	args := append(props.merge(policy).args(), c.Params...)
+	logf(DEBUG, "server: zfs recv %v\n", args)
 
-	recvOut, err := cmd.StdoutPipe()
-	panicOn(err)
-	go printLines("zfs recv: ", recvOut)
+	_, err = receiveStream(args, cr)
+	if exitCode(err) == exitProtocol {
+		return err
+	}
+	if err != nil {
+		logf(INFO, "server: %v\n", err)
+		return e.Encode(errorCommand(err))
+	}
+	return e.Encode(transferResult(sp, cr.Sum(), cr.Chunks()))
+}
 
-	err = cmd.Start()
-	panicOn(err)
+// refuseReceive replies to CmdReceive with CmdError. Without the preflight
+// capability the client sends the stream regardless, and it is skipped first.
+func refuseReceive(e *gob.Encoder, in io.Reader, p protocol, rerr error) error {
+	if !p.has(capPreflight) {
+		cr, err := p.stream.reader(in)
+		if err == nil {
+			err = drain(cr)
+		}
+		if err != nil {
+			return protocolError(err)
+		}
+	}
+	err := e.Encode(errorCommand(rerr))
+	if err != nil {
+		return protocolError(err)
+	}
+	return nil
+}
 
-	bufRecvIn := bufio.NewWriterSize(recvIn, opts.bufferBytes)
-	cr := ChunkedReader{in}
-	_, err = io.Copy(bufRecvIn, cr)
-	panicOn(err)
+// send runs "zfs send" with the parameters of the command, writing the
+// chunked stream to out followed by CmdResult, carrying the checksum of the
+// stream, or CmdError.
+func send(c Command, e *gob.Encoder, out io.Writer, sp streamParams) error {
+	st, err := sendStream(c.Params, out, sp, false)
+	if exitCode(err) == exitProtocol {
+		return err
+	}
+	if err != nil {
+		logf(INFO, "server: %v\n", err)
+		return e.Encode(errorCommand(err))
+	}
+	return e.Encode(transferResult(sp, st.sum, st.chunks))
+}
 
-	err = bufRecvIn.Flush()
-	panicOn(err)
+// transferResult is the reply to a completed transfer. With checksums it
+// carries the SHA-256 of the stream and the number of chunks it was sent in.
+func transferResult(sp streamParams, sum string, chunks int) Command {
+	if !sp.checksums {
+		return Command{Command: CmdResult}
+	}
+	return Command{Command: CmdResult, Params: []string{sum, strconv.Itoa(chunks)}}
+}
 
-	err = recvIn.Close()
-	panicOn(err)
+// createBookmark creates a bookmark given the dataset, the snapshot and the
+// bookmark name as parameters.
+func createBookmark(c Command, e *gob.Encoder) error {
+	if len(c.Params) != 3 {
+		return e.Encode(errorCommand(fmt.Errorf("bookmark: expected dataset, snapshot and bookmark")))
+	}
+	ds, snap, name := c.Params[0], c.Params[1], c.Params[2]
+	err := zfs.CreateBookmark(ds, snap, name)
+	if err != nil {
+		err = fmt.Errorf("bookmarking %s@%s: %v", ds, snap, err)
+		logf(INFO, "server: %v\n", err)
+		return e.Encode(errorCommand(err))
+	}
+	logf(VERBOSE, "server: created bookmark %s#%s\n", ds, name)
+	return e.Encode(Command{Command: CmdResult})
+}
 
-	err = cmd.Wait()
-	panicOn(err)
+// destroySnapshots destroys the snapshots given as parameters following
+// the dataset, which is optionally preceded by "-r" for a recursive destroy.
+func destroySnapshots(c Command, e *gob.Encoder) error {
+	params := c.Params
+	recursive := params[0] == "-r"
+	if recursive {
+		params = params[1:]
+	}
+	if len(params) == 0 {
+		return e.Encode(errorCommand(fmt.Errorf("destroy: missing dataset")))
+	}
 
-	resp := Command{Command: CmdResult}
-	err = e.Encode(&resp)
-	panicOn(err)
+	ds := params[0]
+	for _, name := range params[1:] {
+		var err error
+		if recursive {
+			err = zfs.DestroySnapshotRecursive(ds, name)
+		} else {
+			err = zfs.DestroySnapshot(ds, name)
+		}
+		if err != nil {
+			err = fmt.Errorf("destroying %s@%s: %v", ds, name, err)
+			logf(INFO, "server: %v\n", err)
+			return e.Encode(errorCommand(err))
+		}
+		logf(VERBOSE, "server: destroyed %s@%s\n", ds, name)
+	}
+	return e.Encode(Command{Command: CmdResult})
 }
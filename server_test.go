@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"io/ioutil"
+	"testing"
+)
+
+// serveScript runs the server on the commands, and the streams following
+// them, written by client after saying hello, and returns the replies after
+// the handshake.
+func serveScript(t *testing.T, hello hello, acl *access, client func(e *gob.Encoder, w *bytes.Buffer)) ([]Command, error) {
+	var in, out bytes.Buffer
+	e := gob.NewEncoder(&in)
+	var data bytes.Buffer
+	if err := gob.NewEncoder(&data).Encode(hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Encode(Command{Command: CmdVersion, Params: []string{protocolMagic}, Data: data.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	client(e, &in)
+
+	err := serve(&in, &out, acl)
+
+	var replies []Command
+	d := gob.NewDecoder(&out)
+	for {
+		var c Command
+		if d.Decode(&c) != nil {
+			break
+		}
+		if c.Command != CmdVersion {
+			replies = append(replies, c)
+		}
+	}
+	return replies, err
+}
+
+func TestServeReceiveDenied(t *testing.T) {
+	// The client waits for the reply and sends no stream.
+	replies, err := serveScript(t, localHello(""), testAccess, func(e *gob.Encoder, w *bytes.Buffer) {
+		e.Encode(Command{Command: CmdReceive, Params: []string{"tank/other"}})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 1 || replies[0].Command != CmdError {
+		t.Errorf("replies %v, expected one CmdError", replies)
+	}
+
+	// A client without preflight sends the stream, which is skipped.
+	old := localHello("")
+	old.Capabilities = []string{capChecksums}
+	replies, err = serveScript(t, old, testAccess, func(e *gob.Encoder, w *bytes.Buffer) {
+		e.Encode(Command{Command: CmdReceive, Params: []string{"tank/other"}})
+		w.Write(chunked(t, randomData(3*minMaxChunk), "none", defaultMaxChunk))
+		e.Encode(Command{Command: CmdReceive, Params: []string{"tank/other"}})
+		w.Write(chunked(t, nil, "none", defaultMaxChunk))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || replies[0].Command != CmdError || replies[1].Command != CmdError {
+		t.Errorf("replies %v, expected two CmdErrors", replies)
+	}
+}
+
+func TestServeReceive(t *testing.T) {
+	out := fakeZfs(t)
+	data := randomData(3 * minMaxChunk)
+	replies, err := serveScript(t, localHello(""), testAccess, func(e *gob.Encoder, w *bytes.Buffer) {
+		e.Encode(Command{Command: CmdReceive, Params: []string{"tank/backup/web1"}})
+		w.Write(chunked(t, data, "none", defaultMaxChunk))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 2 || replies[0].Command != CmdResult || len(replies[0].Params) != 0 || replies[1].Command != CmdResult {
+		t.Errorf("replies %v, expected acceptance and the result", replies)
+	}
+	received, _ := ioutil.ReadFile(out)
+	if !bytes.Equal(received, data) {
+		t.Error("zfs recv did not get the stream")
+	}
+}
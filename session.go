@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bufio"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/calmh/zfs"
+)
+
+// A session is a connection to a zsync server on a remote host, over which
+// any number of requests and transfers can be made in sequence.
+type session struct {
+	host   string
+	conn   conn
+	r      *bufio.Reader
+	e      *gob.Encoder
+	d      *gob.Decoder
+	broken error
+
+	// The protocol agreed with the server.
+	proto protocol
+}
+
+// dial connects to the zsync server on the host and negotiates the
+// protocol.
+func dial(host string) (*session, error) {
+	if _, ok := codecs[opts.Compress]; !ok && opts.Compress != "auto" {
+		return nil, localError(fmt.Errorf("unknown compression %q (available: %s)", opts.Compress, strings.Join(compressionNames(), ", ")), "")
+	}
+
+	t, err := newTransport()
+	if err != nil {
+		return nil, localError(err, "")
+	}
+
+	c, err := t.Dial(host)
+	if err != nil {
+		return nil, protocolError(err)
+	}
+
+	r := bufio.NewReader(c)
+	s := &session{
+		host: host,
+		conn: c,
+		r:    r,
+		e:    gob.NewEncoder(c),
+		d:    gob.NewDecoder(r),
+	}
+
+	s.proto, err = negotiateVersion(s.e, s.d, opts.Compress)
+	if err != nil {
+		s.abort()
+		return nil, err
+	}
+	logf(DEBUG, "zsync: %s: protocol %v\n", host, s.proto)
+	if s.proto.version < maxProtocolVersion {
+		logf(VERBOSE, "zsync: %s speaks protocol version %d only\n", host, s.proto.version)
+	}
+	if s.proto.stream.compress != "none" {
+		logf(VERBOSE, "zsync: using %s compression\n", s.proto.stream.compress)
+	}
+	emit("handshake", "", newHandshakeEvent(host, s.proto))
+	return s, nil
+}
+
+// Close ends the session, waiting for the server to exit.
+func (s *session) Close() error {
+	if s.broken != nil {
+		s.abort()
+		return nil
+	}
+
+	err := s.conn.Close()
+	if err != nil {
+		return protocolError(err)
+	}
+	return nil
+}
+
+func (s *session) abort() {
+	s.conn.Abort()
+}
+
+// check records protocol errors, after which the session is out of sync
+// and can not be used for further requests.
+func (s *session) check(err error) error {
+	if err != nil && exitCode(err) == exitProtocol {
+		s.broken = err
+	}
+	return err
+}
+
+func (s *session) request(c Command) error {
+	if s.broken != nil {
+		return protocolError(fmt.Errorf("session to %s failed earlier: %v", s.host, s.broken))
+	}
+	if cap, ok := commandCapabilities[c.Command]; ok {
+		if err := s.require(cap); err != nil {
+			return err
+		}
+	}
+	err := s.e.Encode(c)
+	if err != nil {
+		return s.check(protocolError(err))
+	}
+	return nil
+}
+
+// require returns an error unless the capability was agreed with the
+// server.
+func (s *session) require(capability string) error {
+	if !s.proto.has(capability) {
+		return &exitError{code: exitRemote, err: fmt.Errorf("%s does not support the %s capability", s.host, capability)}
+	}
+	return nil
+}
+
+func (s *session) listSnapshots(ds string) ([]zfs.SnapshotEntry, error) {
+	err := s.request(Command{Command: CmdListSnapshots, Params: []string{ds}})
+	if err != nil {
+		return nil, err
+	}
+
+	var snapshots []zfs.SnapshotEntry
+	if s.proto.version < 2 {
+		// Version 1 replies with the bare list.
+		err = s.d.Decode(&snapshots)
+		if err != nil {
+			return nil, s.check(protocolError(err))
+		}
+		return snapshots, nil
+	}
+
+	res, err := readResult(s.d)
+	if err != nil {
+		return nil, s.check(err)
+	}
+
+	err = decodeData(res, &snapshots)
+	if err != nil {
+		return nil, s.check(err)
+	}
+	return snapshots, nil
+}
+
+// resumeToken asks the server for the receive_resume_token of the
+// destination dataset. An empty string means there is nothing to resume.
+func (s *session) resumeToken(ds string) (string, error) {
+	err := s.request(Command{Command: CmdResumeToken, Params: []string{ds}})
+	if err != nil {
+		return "", err
+	}
+
+	command, err := readResult(s.d)
+	if err != nil {
+		return "", s.check(err)
+	}
+
+	if len(command.Params) == 0 {
+		return "", nil
+	}
+	return command.Params[0], nil
+}
+
+// destroySnapshots asks the server to destroy the named snapshots of ds,
+// and of its descendents if recursive is set.
+func (s *session) destroySnapshots(ds string, recursive bool, names []string) error {
+	var params []string
+	if recursive {
+		params = append(params, "-r")
+	}
+	params = append(params, ds)
+	params = append(params, names...)
+	err := s.request(Command{Command: CmdDestroySnapshots, Params: params})
+	if err != nil {
+		return err
+	}
+
+	_, err = readResult(s.d)
+	return s.check(err)
+}
+
+// listBookmarks lists the bookmarks of ds on the server. Servers without
+// bookmark support have none to offer.
+func (s *session) listBookmarks(ds string) ([]zfs.BookmarkEntry, error) {
+	if !s.proto.has(capBookmarks) {
+		return nil, nil
+	}
+	err := s.request(Command{Command: CmdListBookmarks, Params: []string{ds}})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := readResult(s.d)
+	if err != nil {
+		return nil, s.check(err)
+	}
+
+	var bookmarks []zfs.BookmarkEntry
+	err = decodeData(res, &bookmarks)
+	if err != nil {
+		return nil, s.check(err)
+	}
+	return bookmarks, nil
+}
+
+// createBookmark asks the server to bookmark ds@snap as ds#name.
+func (s *session) createBookmark(ds, snap, name string) error {
+	err := s.request(Command{Command: CmdCreateBookmark, Params: []string{ds, snap, name}})
+	if err != nil {
+		return err
+	}
+
+	_, err = readResult(s.d)
+	return s.check(err)
+}
+
+// estimateSend asks the server for the size of "zfs send" with args.
+func (s *session) estimateSend(args []string) (sendEstimate, error) {
+	var est sendEstimate
+	err := s.request(Command{Command: CmdEstimateSend, Params: args})
+	if err != nil {
+		return est, err
+	}
+
+	res, err := readResult(s.d)
+	if err != nil {
+		return est, s.check(err)
+	}
+
+	err = decodeData(res, &est)
+	return est, s.check(err)
+}
+
+// listDatasets lists ds and its descendants on the server.
+func (s *session) listDatasets(ds string) ([]zfs.ListEntry, error) {
+	err := s.request(Command{Command: CmdListDatasets, Params: []string{ds}})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := readResult(s.d)
+	if err != nil {
+		return nil, s.check(err)
+	}
+
+	var datasets []zfs.ListEntry
+	err = decodeData(res, &datasets)
+	return datasets, s.check(err)
+}
+
+// poolFeatures asks the server for the features of the pool of ds.
+func (s *session) poolFeatures(ds string) (map[string]string, error) {
+	err := s.request(Command{Command: CmdPoolFeatures, Params: []string{ds}})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := readResult(s.d)
+	if err != nil {
+		return nil, s.check(err)
+	}
+
+	var features map[string]string
+	err = decodeData(res, &features)
+	return features, s.check(err)
+}
+
+func (s *session) String() string {
+	return s.host
+}
+
+// push runs "zfs send" with the given arguments and streams the result to
+// the server, which runs "zfs recv" with recvArgs and the properties. The
+// name is only used for logging.
+func (s *session) push(sendArgs, recvArgs []string, props recvProps, name string) (streamStats, error) {
+	data, err := props.encode()
+	if err != nil {
+		return streamStats{}, localError(err, "")
+	}
+	err = s.request(Command{Command: CmdReceive, Params: recvArgs, Data: data})
+	if err != nil {
+		return streamStats{}, err
+	}
+	if s.proto.has(capPreflight) {
+		// The server refuses the receive before we start zfs send.
+		_, err = readResult(s.d)
+		err = s.check(err)
+		if err != nil {
+			return streamStats{}, err
+		}
+	}
+
+	logf(VERBOSE, "zsync: sending %s\n", name)
+
+	t0 := time.Now()
+	st, sendErr := sendStream(sendArgs, s.conn, s.proto.stream, opts.Progress)
+	if exitCode(sendErr) == exitProtocol {
+		return st, s.check(sendErr)
+	}
+
+	res, err := readResult(s.d)
+	err = s.check(err)
+	if sendErr != nil {
+		return st, sendErr
+	}
+	if err != nil {
+		return st, err
+	}
+
+	err = s.verified(res, st.sum, st.chunks)
+	if err != nil {
+		return st, err
+	}
+	s.logRate("sent", name, st.n, st.wire, t0)
+	return st, nil
+}
+
+// pull asks the server to run "zfs send" with the given arguments and
+// receives the stream locally with "zfs recv", recvArgs and the
+// properties. The name is only used for logging.
+func (s *session) pull(sendArgs, recvArgs []string, props recvProps, name string) (streamStats, error) {
+	var st streamStats
+	var expected int64
+	if opts.Progress && s.proto.has(capEstimate) {
+		est, err := s.estimateSend(sendArgs)
+		if err != nil {
+			logf(VERBOSE, "zsync: cannot estimate stream size: %v\n", err)
+		}
+		expected = est.Size
+	}
+
+	err := s.request(Command{Command: CmdSend, Params: sendArgs})
+	if err != nil {
+		return st, err
+	}
+
+	logf(VERBOSE, "zsync: receiving %s\n", name)
+
+	t0 := time.Now()
+	wire := &countingReader{Reader: s.r}
+	cr, err := s.proto.stream.reader(wire)
+	if err != nil {
+		return st, localError(err, "")
+	}
+	var in io.Reader = cr
+	var prog *progress
+	if opts.Progress {
+		prog = newProgress(expected)
+		in = prog.Reader(in)
+	}
+	n, recvErr := receiveStream(append(props.args(), recvArgs...), in)
+	if prog != nil {
+		prog.Stop()
+	}
+	st = streamStats{n: n, wire: wire.n, chunks: cr.Chunks(), sum: cr.Sum()}
+	if exitCode(recvErr) == exitProtocol {
+		return st, s.check(recvErr)
+	}
+
+	res, err := readResult(s.d)
+	err = s.check(err)
+	if err != nil {
+		return st, err
+	}
+	if recvErr != nil {
+		return st, recvErr
+	}
+
+	err = s.verified(res, st.sum, st.chunks)
+	if err != nil {
+		return st, err
+	}
+	s.logRate("received", name, st.n, st.wire, t0)
+	return st, nil
+}
+
+// verified compares the checksum in the result of a transfer with the one
+// computed locally over the same stream.
+func (s *session) verified(res Command, sum string, chunks int) error {
+	if !s.proto.stream.checksums {
+		return nil
+	}
+	if len(res.Params) < 1 || res.Params[0] != sum {
+		return s.check(protocolError(fmt.Errorf("stream checksum mismatch (sha256 %s != %v)", sum, res.Params)))
+	}
+	logf(VERBOSE, "zsync: verified %d chunks, sha256 %s\n", chunks, sum)
+	return nil
+}
+
+// logRate logs the completion of a transfer of n bytes, of which wire
+// bytes were on the wire.
+func (s *session) logRate(verb, name string, n, wire int64, t0 time.Time) {
+	td := time.Since(t0)
+	onWire := ""
+	if s.proto.stream.compress != "none" {
+		onWire = fmt.Sprintf(" (%sB on the wire)", toSi(int(wire)))
+	}
+	logf(INFO, "zsync: %s %s; %sB%s in %.2f seconds (%sB/s)\n", verb, name, toSi(int(n)), onWire, td.Seconds(), toSi(int(float64(n)/td.Seconds())))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+)
+
+// sendStream runs "zfs send" with args and writes the stream, chunked and
+// compressed, to out. The chunked stream is terminated even if zfs send
+// fails or can not be started, so that the receiving side stays in step; it
+// will fail to receive the truncated or empty stream. A failure to write to
+// out is returned as a protocol error.
+func sendStream(args []string, out io.Writer, sp streamParams, showProgress bool) (streamStats, error) {
+	var st streamStats
+	var expected int64
+	var err error
+	if showProgress {
+		expected, err = estimateSize(args)
+		if err != nil {
+			logf(VERBOSE, "zsync: cannot estimate stream size: %v\n", err)
+		}
+	}
+
+	bufout := bufio.NewWriterSize(out, opts.bufferBytes)
+	wire := &countingWriter{Writer: bufout}
+	chunkout, err := sp.writer(wire)
+	if err != nil {
+		// The terminator has no payload, so needs no codec.
+		chunkout = NewChunkedWriter(wire, nil, sp.maxChunk)
+		chunkout.plain = !sp.checksums
+		return st, endStream(chunkout, bufout, localError(err, ""))
+	}
+
+	params := append([]string{"send"}, args...)
+	cmd := exec.Command("zfs", params...)
+	output := newLineLog("zfs send: ")
+	cmd.Stderr = output
+	stream, err := cmd.StdoutPipe()
+	if err != nil {
+		return st, endStream(chunkout, bufout, localError(err, ""))
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return st, endStream(chunkout, bufout, cmdError("zfs send", err, output))
+	}
+	defer reap(cmd)
+	var src io.Reader = stream
+	var prog *progress
+	if showProgress {
+		prog = newProgress(expected)
+		src = prog.Reader(stream)
+	}
+	st.n, err = io.Copy(chunkout, src)
+	if prog != nil {
+		prog.Stop()
+	}
+	if err != nil {
+		return st, protocolError(err)
+	}
+
+	sendErr := cmd.Wait()
+
+	err = chunkout.Flush()
+	if err == nil {
+		err = bufout.Flush()
+	}
+	st.wire = wire.n
+	st.sum = chunkout.Sum()
+	st.chunks = chunkout.Chunks()
+	if err != nil {
+		return st, protocolError(err)
+	}
+
+	if sendErr != nil {
+		return st, cmdError("zfs send", sendErr, output)
+	}
+	return st, nil
+}
+
+// endStream terminates the chunked stream, written to out through w, that
+// zfs send failed to fill, and returns err; or a protocol error if the
+// stream could not be terminated.
+func endStream(w *ChunkedWriter, out *bufio.Writer, err error) error {
+	ferr := w.Flush()
+	if ferr == nil {
+		ferr = out.Flush()
+	}
+	if ferr != nil {
+		return protocolError(ferr)
+	}
+	return err
+}
+
+// streamStats describes a stream sent or received.
+type streamStats struct {
+	n      int64  // bytes sent by zfs
+	wire   int64  // bytes on the wire
+	chunks int    // chunks on the wire
+	sum    string // hex SHA-256 of the stream
+}
+
+// receiveStream runs "zfs recv" with args on the chunked stream read from
+// in. The stream is consumed to its end even if zfs recv fails, so that the
+// session can continue; if that is not possible a protocol error is
+// returned. A checksum mismatch kills zfs recv before its input is closed.
+// As the chunked reader holds back the last chunk, with the END record of
+// the zfs stream, until the trailer has been verified, zfs recv never sees
+// the end of a corrupted stream and does not commit it.
+func receiveStream(args []string, in io.Reader) (int64, error) {
+	params := append([]string{"recv"}, args...)
+	cmd := exec.Command("zfs", params...)
+	output := newLineLog("zfs recv: ")
+	cmd.Stdout = output
+	cmd.Stderr = output
+	defer reap(cmd)
+
+	n, err := runReceive(cmd, in)
+	if cerr, ok := err.(copyError); ok {
+		// zfs recv did not start, gave up or the stream broke. Consume the rest of the
+		// stream; if that fails too it's the stream that is broken.
+		derr := drain(in)
+		if derr != nil {
+			return n, protocolError(derr)
+		}
+		reap(cmd)
+		if _, ok := cerr.error.(checksumError); ok {
+			return n, localError(fmt.Errorf("receiving stream: %v", cerr.error), "")
+		}
+		return n, cmdError("zfs recv", cerr.error, output)
+	}
+	if err != nil {
+		return n, cmdError("zfs recv", err, output)
+	}
+	return n, nil
+}
+
+// A copyError is a failure before the stream has been consumed: starting
+// zfs recv or copying the stream into it.
+type copyError struct {
+	error
+}
+
+func runReceive(cmd *exec.Cmd, in io.Reader) (int64, error) {
+	recvIn, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, copyError{err}
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return 0, copyError{err}
+	}
+
+	bufRecvIn := bufio.NewWriterSize(recvIn, opts.bufferBytes)
+	n, err := io.Copy(bufRecvIn, in)
+	if err != nil {
+		return n, copyError{err}
+	}
+
+	err = bufRecvIn.Flush()
+	if err != nil {
+		return n, err
+	}
+
+	err = recvIn.Close()
+	if err != nil {
+		return n, err
+	}
+
+	return n, cmd.Wait()
+}
+
+// drain reads and discards the rest of a chunked stream. Checksum errors
+// are skipped, as the framing is intact and the stream already known to be
+// corrupt.
+func drain(r io.Reader) error {
+	for {
+		_, err := io.Copy(ioutil.Discard, r)
+		if _, ok := err.(checksumError); !ok {
+			return err
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeZfs puts a zfs on the PATH that copies its input to the returned file.
+func fakeZfs(t *testing.T) string {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "received")
+	script := "#!/bin/sh\nexec cat > " + out + "\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "zfs"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return out
+}
+
+// brokenZfs puts a zfs on the PATH that can not be run at all, or that
+// fails at once if failing is true.
+func brokenZfs(t *testing.T, failing bool) {
+	dir := t.TempDir()
+	script, mode := "", os.FileMode(0644)
+	if failing {
+		script, mode = "#!/bin/sh\necho failing >&2\nexit 1\n", 0755
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "zfs"), []byte(script), mode); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestSendStreamFailing(t *testing.T) {
+	for _, failing := range []bool{false, true} {
+		brokenZfs(t, failing)
+		for _, compress := range compressionNames() {
+			sp := streamParams{compress, minMaxChunk, true}
+			var out bytes.Buffer
+			_, err := sendStream([]string{"tank/a@1"}, &out, sp, false)
+			if err == nil {
+				t.Errorf("%v/%s: zfs send did not fail", failing, compress)
+				continue
+			}
+			if exitCode(err) != exitLocal {
+				t.Errorf("%v/%s: unexpected error %v (exit code %d)", failing, compress, err, exitCode(err))
+			}
+
+			// The receiving side gets an empty, terminated stream.
+			out.WriteString("next")
+			r, err := sp.reader(&out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := ioutil.ReadAll(r)
+			if err != nil || len(data) != 0 {
+				t.Errorf("%v/%s: read %d bytes, error %v, from the stream", failing, compress, len(data), err)
+			}
+			if out.String() != "next" {
+				t.Errorf("%v/%s: %q left after the stream", failing, compress, out.String())
+			}
+		}
+	}
+}
+
+func TestSendStreamUnknownCodec(t *testing.T) {
+	var out bytes.Buffer
+	_, err := sendStream([]string{"tank/a@1"}, &out, streamParams{"teleport", minMaxChunk, true}, false)
+	if err == nil || exitCode(err) != exitLocal {
+		t.Errorf("unexpected error %v", err)
+	}
+	r, err := streamParams{"none", minMaxChunk, true}.reader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadAll(r); err != nil || len(data) != 0 {
+		t.Errorf("read %d bytes, error %v, from the stream", len(data), err)
+	}
+}
+
+func TestReceiveStreamNoZfs(t *testing.T) {
+	brokenZfs(t, false)
+	data := randomData(10 * minMaxChunk)
+	stream := append(chunked(t, data, "none", minMaxChunk), "next"...)
+
+	in := bytes.NewReader(stream)
+	r, err := streamParams{"none", minMaxChunk, true}.reader(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = receiveStream([]string{"tank/a"}, r)
+	if err == nil || exitCode(err) != exitLocal {
+		t.Errorf("unexpected error %v", err)
+	}
+	if in.Len() != len("next") {
+		t.Errorf("%d bytes left after the stream, not %d", in.Len(), len("next"))
+	}
+	if _, err := r.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stream not read to its end: %v", err)
+	}
+}
+
+func TestReceiveStream(t *testing.T) {
+	out := fakeZfs(t)
+	data := randomData(10 * minMaxChunk)
+	stream := chunked(t, data, "none", minMaxChunk)
+
+	r, err := streamParams{"none", minMaxChunk, true}.reader(bytes.NewReader(stream))
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := receiveStream([]string{"tank/a"}, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(len(data)) {
+		t.Errorf("received %d bytes, not %d", n, len(data))
+	}
+	received, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, data) {
+		t.Error("zfs recv did not get the stream")
+	}
+}
+
+func TestReceiveStreamCorrupt(t *testing.T) {
+	// Uncompressed, each chunk is its length, crc and minMaxChunk bytes.
+	const chunkSize = 8 + minMaxChunk
+	data := randomData(10 * minMaxChunk)
+	stream := chunked(t, data, "none", minMaxChunk)
+
+	for _, c := range []struct {
+		name   string
+		offset int
+	}{
+		{"first chunk", 8 + 10},
+		{"middle chunk", 4*chunkSize + 8 + 10},
+		{"last chunk", 9*chunkSize + 8 + 10},
+		{"trailer", len(stream) - 10},
+	} {
+		out := fakeZfs(t)
+		corrupt := append([]byte(nil), stream...)
+		corrupt[c.offset] ^= 0x10
+		// The session goes on after the stream.
+		corrupt = append(corrupt, "next"...)
+
+		in := bytes.NewReader(corrupt)
+		r, err := streamParams{"none", minMaxChunk, true}.reader(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = receiveStream([]string{"tank/a"}, r)
+		if err == nil {
+			t.Errorf("%s: corruption not detected", c.name)
+			continue
+		}
+		if exitCode(err) != exitLocal || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("%s: unexpected error %v (exit code %d)", c.name, err, exitCode(err))
+		}
+		if in.Len() != len("next") {
+			t.Errorf("%s: %d bytes left after the stream, not %d", c.name, in.Len(), len("next"))
+		}
+		// zfs recv must not have seen the end of the stream.
+		received, _ := ioutil.ReadFile(out)
+		if len(received) >= len(data) {
+			t.Errorf("%s: zfs recv got %d bytes, the whole stream", c.name, len(received))
+		}
+	}
+}
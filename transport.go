@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// A transport establishes connections to zsync servers.
+type transport interface {
+	Dial(host string) (conn, error)
+}
+
+// A conn is a duplex stream to a zsync server.
+type conn interface {
+	io.Reader
+	io.Writer
+	// Close ends the connection in an orderly fashion, waiting for the
+	// server to finish.
+	Close() error
+	// Abort tears down the connection immediately.
+	Abort()
+}
+
+func newTransport() (transport, error) {
+	switch opts.Transport {
+	case "ssh":
+		return sshTransport{
+			port:     opts.Port,
+			identity: opts.Identity,
+			cipher:   opts.Cipher,
+			options:  opts.SSHOptions,
+		}, nil
+	case "tcp":
+		if opts.Port == 0 {
+			return nil, fmt.Errorf("the tcp transport requires --port")
+		}
+		return tcpTransport{port: opts.Port}, nil
+	case "tls":
+		if opts.Port == 0 {
+			return nil, fmt.Errorf("the tls transport requires --port")
+		}
+		cfg, err := tlsConfig(false)
+		if err != nil {
+			return nil, err
+		}
+		return tlsTransport{port: opts.Port, cfg: cfg}, nil
+	case "local":
+		return localTransport{}, nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", opts.Transport)
+	}
+}
+
+// sshTransport runs "zsync --server" on the remote host over ssh.
+type sshTransport struct {
+	port     int
+	identity string
+	cipher   string
+	options  []string
+}
+
+func (t sshTransport) Dial(host string) (conn, error) {
+	var args []string
+	if t.port != 0 {
+		args = append(args, "-p", strconv.Itoa(t.port))
+	}
+	if t.identity != "" {
+		args = append(args, "-i", t.identity)
+	}
+	if t.cipher != "" {
+		args = append(args, "-c", t.cipher)
+	}
+	for _, o := range t.options {
+		args = append(args, "-o", o)
+	}
+	args = append(args, host, opts.ZsyncPath, "--server")
+
+	cmd := exec.Command("ssh", args...)
+	cmd.Stderr = newLineLog("remote: ")
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("ssh: %v", err)
+	}
+
+	return &sshConn{stdout, stdin, cmd}, nil
+}
+
+type sshConn struct {
+	io.Reader
+	in  io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func (c *sshConn) Write(bs []byte) (int, error) {
+	return c.in.Write(bs)
+}
+
+func (c *sshConn) Close() error {
+	c.in.Close()
+	err := c.cmd.Wait()
+	if err != nil {
+		return fmt.Errorf("ssh: %v", err)
+	}
+	return nil
+}
+
+func (c *sshConn) Abort() {
+	reap(c.cmd)
+}
+
+// tcpTransport connects to a server started with --server --listen and
+// --restrict.
+type tcpTransport struct {
+	port int
+}
+
+func (t tcpTransport) Dial(host string) (conn, error) {
+	c, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(t.port)))
+	if err != nil {
+		return nil, err
+	}
+	return netConn{c}, nil
+}
+
+type netConn struct {
+	net.Conn
+}
+
+func (c netConn) Abort() {
+	c.Conn.Close()
+}
+
+// localTransport runs the server in process, for copies between datasets on
+// the same host. The host name is ignored.
+type localTransport struct{}
+
+func (localTransport) Dial(host string) (conn, error) {
+	// OS pipes rather than net.Pipe, as both sides start by writing their
+	// version before reading and so need some buffering.
+	cr, sw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	sr, cw, err := os.Pipe()
+	if err != nil {
+		cr.Close()
+		sw.Close()
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serve(sr, sw, nil)
+		sr.Close()
+		sw.Close()
+	}()
+	return &pipeConn{cr, cw, done}, nil
+}
+
+type pipeConn struct {
+	r    *os.File
+	w    *os.File
+	done chan error
+}
+
+func (c *pipeConn) Read(bs []byte) (int, error) {
+	return c.r.Read(bs)
+}
+
+func (c *pipeConn) Write(bs []byte) (int, error) {
+	return c.w.Write(bs)
+}
+
+func (c *pipeConn) Close() error {
+	c.w.Close()
+	err := <-c.done
+	c.r.Close()
+	return err
+}
+
+func (c *pipeConn) Abort() {
+	c.w.Close()
+	c.r.Close()
+}